@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+)
+
+// defaultApprovalPollInterval is the interval in which the approval
+// ConfigMap is checked.
+const defaultApprovalPollInterval = 10 * time.Second
+
+// planSummaryPattern matches the summary line of terraform plan.
+var planSummaryPattern = regexp.MustCompile(`(?m)^(Plan: .*|Changes to Outputs:)$`)
+
+// planSummary returns the summary line of the plan output.
+func planSummary(planOutput []byte) string {
+	m := planSummaryPattern.Find(planOutput)
+	if m == nil {
+		return "Changes detected."
+	}
+	return string(m)
+}
+
+// approvalName returns the name of the approval ConfigMap of this build.
+// Without a build identifier, runs of the same component and environment
+// could share (and approve) each other's ConfigMap, so this fails instead.
+func (d *deployTerraform) approvalName() (string, error) {
+	if d.opts.build == "" {
+		return "", errors.New("approval requires the identifier of the build (e.g. the TaskRun name) to be set via -build")
+	}
+	return kubernetes.ApprovalConfigMapName(d.opts.build), nil
+}
+
+// approvalSummary lists the plan summary of each terraform config with
+// changes.
+func (d *deployTerraform) approvalSummary() string {
+	lines := []string{fmt.Sprintf("Target environment: %s", d.opts.targetEnvironment)}
+	if d.ctxt.GitCommitSHA != "" {
+		lines = append(lines, fmt.Sprintf("Git commit: %s (%s)", d.ctxt.GitCommitSHA, d.ctxt.GitRef))
+	}
+	for _, tfConfig := range d.tfConfigs {
+		if tfConfig.hasChanges {
+			lines = append(lines, fmt.Sprintf("%s: %s", tfConfig.terraformDir, tfConfig.planSummary))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// awaitApproval publishes the plan summary in an approval ConfigMap in the
+// namespace of the pipeline and waits until an approver sets its status to
+// approved or rejected, or approval-timeout expires. The ConfigMap is deleted
+// once the run finishes, the decision is logged. The approver is
+// self-declared and not verified, restricting who may approve is left to
+// RBAC. Next to it, the field manager which set the status is logged.
+func awaitApproval() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if !d.opts.requireApproval {
+			return d, nil
+		}
+		timeout, err := time.ParseDuration(d.opts.approvalTimeout)
+		if err != nil {
+			return d, fmt.Errorf("parse approval-timeout: %w", err)
+		}
+		namespace := d.ctxt.Namespace
+		name, err := d.approvalName()
+		if err != nil {
+			return d, err
+		}
+		summary := d.approvalSummary()
+		if err := kubernetes.RequestApproval(d.clientset, namespace, name, summary); err != nil {
+			return d, fmt.Errorf("request approval: %w", err)
+		}
+		d.addCleanup(func() {
+			if err := kubernetes.DeleteApproval(d.clientset, namespace, name); err != nil {
+				d.logger.Warnf("Could not delete approval configmap %s: %s", name, err)
+			}
+		})
+		d.logger.Infof("Plan awaits approval:\n%s", summary)
+		d.logger.Infof(
+			"Waiting up to %s for approval. Approve (or reject) with: kubectl -n %s patch configmap %s --type merge -p '{\"data\":{\"status\":\"approved\",\"approver\":\"<name>\"}}'",
+			timeout, namespace, name,
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		approval, err := kubernetes.WaitForApproval(ctx, d.clientset, namespace, name, d.approvalPollInterval)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return d, fmt.Errorf("plan was not approved within %s", timeout)
+			}
+			return d, fmt.Errorf("wait for approval: %w", err)
+		}
+		approver := describeApprover(approval)
+		if approval.Status == kubernetes.ApprovalStatusRejected {
+			return d, fmt.Errorf("plan was rejected by %s: %s", approver, approval.Reason)
+		}
+		d.logger.Infof("Plan was approved by %s.", approver)
+		return d, nil
+	}
+}
+
+// describeApprover returns the self-declared approver of approval together
+// with the field manager which set the status, if recorded. Neither is an
+// authenticated identity.
+func describeApprover(approval *kubernetes.Approval) string {
+	approver := approval.Approver
+	if approver == "" {
+		approver = "unknown approver"
+	}
+	if approval.StatusManager == "" {
+		return approver
+	}
+	return fmt.Sprintf(
+		"%s (self-declared; status set via field manager %s at %s)",
+		approver, approval.StatusManager, approval.StatusTime.UTC().Format(time.RFC3339),
+	)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlanSummary(t *testing.T) {
+	tests := map[string]struct {
+		output string
+		want   string
+	}{
+		"resources": {
+			output: "  # null_resource.foo will be created\n\nPlan: 1 to add, 0 to change, 0 to destroy.\n",
+			want:   "Plan: 1 to add, 0 to change, 0 to destroy.",
+		},
+		"outputs only": {
+			output: "Changes to Outputs:\n  + foo = \"bar\"\n",
+			want:   "Changes to Outputs:",
+		},
+		"unknown": {
+			output: "something else\n",
+			want:   "Changes detected.",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := planSummary([]byte(tc.output)); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAwaitApproval(t *testing.T) {
+	decided := metav1.NewTime(time.Date(2024, 1, 5, 10, 5, 0, 0, time.UTC))
+	tests := map[string]struct {
+		// data set by the approver, nil for no decision.
+		decision      map[string]string
+		managedFields []metav1.ManagedFieldsEntry
+		wantErr       string
+	}{
+		"approved": {
+			decision: map[string]string{kubernetes.ApprovalStatusKey: kubernetes.ApprovalStatusApproved, kubernetes.ApprovalApproverKey: "jane"},
+		},
+		"rejected": {
+			decision: map[string]string{kubernetes.ApprovalStatusKey: kubernetes.ApprovalStatusRejected, kubernetes.ApprovalApproverKey: "joe", kubernetes.ApprovalReasonKey: "not now"},
+			wantErr:  "plan was rejected by joe: not now",
+		},
+		"rejected with managed fields": {
+			decision: map[string]string{kubernetes.ApprovalStatusKey: kubernetes.ApprovalStatusRejected, kubernetes.ApprovalApproverKey: "joe", kubernetes.ApprovalReasonKey: "not now"},
+			managedFields: []metav1.ManagedFieldsEntry{{
+				Manager:  "kubectl-patch",
+				Time:     &decided,
+				FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:approver":{},"f:reason":{},"f:status":{}}}`)},
+			}},
+			wantErr: "plan was rejected by joe (self-declared; status set via field manager kubectl-patch at 2024-01-05T10:05:00Z): not now",
+		},
+		"timeout": {
+			wantErr: "plan was not approved within 100ms",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			opts := &options{targetEnvironment: "foo-prod", build: "deploy-abcde", requireApproval: true, approvalTimeout: "100ms"}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", Component: "foo", GitCommitSHA: "0123456", GitRef: "main"}
+			d.clientset = clientset
+			d.approvalPollInterval = time.Millisecond
+			d.tfConfigs = []terraformConfig{
+				{terraformDir: "infra/network", hasChanges: true, planSummary: "Plan: 1 to add, 0 to change, 0 to destroy."},
+				{terraformDir: "infra/app"},
+			}
+			if tc.decision != nil {
+				// Play the approver once the approval has been requested.
+				go func() {
+					for {
+						cm, err := clientset.CoreV1().ConfigMaps("foo-cd").Get(context.TODO(), "terraform-approval-deploy-abcde", metav1.GetOptions{})
+						if err == nil {
+							cm.Data = tc.decision
+							cm.ManagedFields = tc.managedFields
+							_, _ = clientset.CoreV1().ConfigMaps("foo-cd").Update(context.TODO(), cm, metav1.UpdateOptions{})
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}()
+			}
+			_, err := awaitApproval()(d)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("want no err, got %s", err)
+				}
+			} else if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+			if tc.decision == nil {
+				data, err := kubernetes.GetConfigMapData(clientset, "foo-cd", "terraform-approval-deploy-abcde")
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantSummary := "Target environment: foo-prod\nGit commit: 0123456 (main)\ninfra/network: Plan: 1 to add, 0 to change, 0 to destroy."
+				if data[kubernetes.ApprovalSummaryKey] != wantSummary {
+					t.Fatalf("want summary:\n%s\ngot:\n%s", wantSummary, data[kubernetes.ApprovalSummaryKey])
+				}
+			}
+			d.cleanup()
+			_, err = clientset.CoreV1().ConfigMaps("foo-cd").Get(context.TODO(), "terraform-approval-deploy-abcde", metav1.GetOptions{})
+			if !k8serrors.IsNotFound(err) {
+				t.Fatalf("want approval configmap to be deleted once the run finishes, got err: %v", err)
+			}
+		})
+	}
+}
+
+func TestAwaitApprovalWithoutBuild(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	opts := &options{targetEnvironment: "foo-prod", requireApproval: true, approvalTimeout: "100ms"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", Component: "foo"}
+	d.clientset = clientset
+	d.tfConfigs = []terraformConfig{{terraformDir: "infra", hasChanges: true}}
+	_, err := awaitApproval()(d)
+	wantErr := "approval requires the identifier of the build (e.g. the TaskRun name) to be set via -build"
+	if err == nil || err.Error() != wantErr {
+		t.Fatalf("want err: %s, got: %v", wantErr, err)
+	}
+	cms, err := clientset.CoreV1().ConfigMaps("foo-cd").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cms.Items) > 0 {
+		t.Fatalf("want no approval configmap, got %s", cms.Items[0].Name)
+	}
+}
@@ -1,6 +1,21 @@
 terraform {
     backend "kubernetes" {
         secret_suffix = "{{.SecretSuffix}}"
+        namespace = "{{.Namespace}}"
+{{- if .Labels}}
+        labels = {
+{{- range $key, $value := .Labels}}
+            "{{$key}}" = "{{$value}}"
+{{- end}}
+        }
+{{- end}}
+{{- if .ConfigPath}}
+        config_path = "{{.ConfigPath}}"
+{{- if .ConfigContext}}
+        config_context = "{{.ConfigContext}}"
+{{- end}}
+{{- else}}
         in_cluster_config = true 
+{{- end}}
     }
 }
\ No newline at end of file
@@ -0,0 +1,13 @@
+terraform {
+    backend "s3" {
+        bucket = "{{.Bucket}}"
+        key = "{{.Key}}"
+{{- if .Region}}
+        region = "{{.Region}}"
+{{- end}}
+{{- if .DynamoDBTable}}
+        dynamodb_table = "{{.DynamoDBTable}}"
+{{- end}}
+        encrypt = true
+    }
+}
\ No newline at end of file
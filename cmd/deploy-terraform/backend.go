@@ -1,45 +1,212 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	backendKubernetes = "kubernetes"
+	backendS3         = "s3"
+
+	// defaultStateSecretSuffix is the naming template of the state secret
+	// suffix used before it became configurable.
+	defaultStateSecretSuffix = "{{.Component}}-{{.Environment}}"
+	// defaultDirStateSecretSuffix is the naming template of the state secret
+	// suffix used instead of defaultStateSecretSuffix for terraform configs
+	// outside of the default terraform directory, so that each config of a
+	// monorepo has its own state.
+	defaultDirStateSecretSuffix = "{{.Component}}-{{.TerraformDir}}-{{.Environment}}"
+	// defaultSubrepoStateSecretSuffix is the naming template of the state
+	// secret suffix of terraform configs in subrepos.
+	defaultSubrepoStateSecretSuffix = "{{.Component}}-{{.Subrepo}}-{{.TerraformDir}}-{{.Environment}}"
 )
 
-const templateBackendKubernetesName = "backend-kubernetes.tf"
+// invalidSecretSuffixChars matches characters not allowed in the state secret suffix.
+var invalidSecretSuffixChars = regexp.MustCompile(`[^a-z0-9-]+`)
 
 var (
-	//go:embed backend-kubernetes.tf
-	templateBackendKubernetesFS embed.FS
-	templateBackendKubernetes   *template.Template
+	//go:embed backend-kubernetes.tf backend-s3.tf
+	templateBackendFS embed.FS
+	templateBackend   *template.Template
 )
 
 func init() {
-	templateBackendKubernetes = template.Must(template.New(templateBackendKubernetesName).ParseFS(templateBackendKubernetesFS, templateBackendKubernetesName))
+	templateBackend = template.Must(template.ParseFS(templateBackendFS, "backend-*.tf"))
 }
 
 type BackendKubernetesData struct {
 	SecretSuffix string
+	// Labels added to the state secret.
+	Labels map[string]string
+	// Namespace in which the state is stored.
+	Namespace string
+	// ConfigPath is the kubeconfig file to use when running outside of the
+	// cluster. If empty, the in-cluster config is used.
+	ConfigPath string
+	// ConfigContext is the kubeconfig context to use with ConfigPath.
+	ConfigContext string
+}
+
+type BackendS3Data struct {
+	Bucket string
+	// Key is the path of the state object in the bucket.
+	Key    string
+	Region string
+	// DynamoDBTable is used for state locking if set.
+	DynamoDBTable string
+}
+
+// backendFilename returns the name of the generated file configuring backend.
+func backendFilename(backend string) string {
+	return fmt.Sprintf("backend-%s.tf", backend)
 }
 
-func (d *deployTerraform) renderBackend() error {
-	destination := filepath.Join(d.opts.terraformDir, "backend-kubernetes.tf")
+// renderBackend renders the configuration of backend storing the state under
+// secretSuffix into dir. Generated configurations of other backends are
+// removed from dir, as a terraform configuration may only have one backend.
+func (d *deployTerraform) renderBackend(backend, dir, secretSuffix string) error {
+	var data interface{}
+	switch backend {
+	case backendKubernetes:
+		data = &BackendKubernetesData{
+			SecretSuffix:  secretSuffix,
+			Labels:        d.stateLabels,
+			Namespace:     d.stateNamespace(),
+			ConfigPath:    d.kubeconfigPath,
+			ConfigContext: d.kubeContext,
+		}
+	case backendS3:
+		if d.opts.s3Bucket == "" {
+			return fmt.Errorf("backend %s requires a bucket", backendS3)
+		}
+		data = &BackendS3Data{
+			Bucket:        d.opts.s3Bucket,
+			Key:           path.Join(d.opts.s3KeyPrefix, secretSuffix, "terraform.tfstate"),
+			Region:        d.opts.s3Region,
+			DynamoDBTable: d.opts.s3DynamoDBTable,
+		}
+	default:
+		return fmt.Errorf("unsupported backend %s, must be one of %s, %s", backend, backendKubernetes, backendS3)
+	}
+	for _, b := range []string{backendKubernetes, backendS3} {
+		// Files of the configuration are symlinked into the scratch copy.
+		// Replacing such a file would drop it (or write through the link).
+		name := backendFilename(b)
+		if fi, err := os.Lstat(filepath.Join(dir, name)); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s of the terraform configuration clashes with the backend configuration generated by this task, rename it", name)
+		}
+	}
+	for _, other := range []string{backendKubernetes, backendS3} {
+		if other == backend {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, backendFilename(other))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove backend %s: %w", other, err)
+		}
+	}
+	destination := filepath.Join(dir, backendFilename(backend))
 	w, err := os.Create(destination)
 	if err != nil {
 		return fmt.Errorf("failed to create file %s: %w", destination, err)
 	}
+	defer w.Close()
 	if _, err := w.Write(
 		[]byte("// File is generated; DO NOT EDIT.\n\n"),
 	); err != nil {
 		return err
 	}
-	err = templateBackendKubernetes.ExecuteTemplate(w, templateBackendKubernetesName, &BackendKubernetesData{
-		SecretSuffix: fmt.Sprintf("%s-%s", d.ctxt.Component, d.opts.targetEnvironment),
-	})
+	err = templateBackend.ExecuteTemplate(w, backendFilename(backend), data)
 	if err != nil {
-		return fmt.Errorf("rendering internal kubernetes backend template failed: %w", err)
+		return fmt.Errorf("rendering internal %s backend template failed: %w", backend, err)
 	}
 	return nil
 }
+
+// StateSecretSuffixData is the data available to the naming template of the
+// state secret suffix.
+type StateSecretSuffixData struct {
+	Project      string
+	Repository   string
+	Component    string
+	Subrepo      string
+	Environment  string
+	TerraformDir string
+}
+
+// stateSecretSuffixTemplate returns the naming template of the state secret
+// suffix of tfConfig. Unless another template is given, the default template
+// is extended by the directory for configs outside of the default terraform
+// directory. The suffix therefore depends only on the config itself, not on
+// which other configs the repository has.
+func (d *deployTerraform) stateSecretSuffixTemplate(tfConfig terraformConfig) string {
+	if tfConfig.subrepo != nil {
+		return d.opts.subrepoStateSecretSuffix
+	}
+	if d.opts.stateSecretSuffix == defaultStateSecretSuffix && filepath.ToSlash(filepath.Clean(tfConfig.relDir)) != "terraform" {
+		return defaultDirStateSecretSuffix
+	}
+	return d.opts.stateSecretSuffix
+}
+
+// stateSecretSuffix renders the naming template tmpl of the state secret
+// suffix of tfConfig. The result is lower-cased and any character not allowed in a label
+// value is replaced by a dash.
+func (d *deployTerraform) stateSecretSuffix(tmpl string, tfConfig terraformConfig) (string, error) {
+	subrepo := ""
+	if tfConfig.subrepo != nil {
+		subrepo = tfConfig.subrepo.Name()
+	}
+	t, err := template.New("state-secret-suffix").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("parse state secret suffix template %q: %w", tmpl, err)
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, &StateSecretSuffixData{
+		Project:      d.ctxt.Project,
+		Repository:   d.ctxt.Repository,
+		Component:    d.ctxt.Component,
+		Subrepo:      subrepo,
+		Environment:  d.opts.targetEnvironment,
+		TerraformDir: filepath.ToSlash(filepath.Clean(tfConfig.relDir)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("render state secret suffix template %q: %w", tmpl, err)
+	}
+	suffix := strings.Trim(invalidSecretSuffixChars.ReplaceAllString(strings.ToLower(b.String()), "-"), "-")
+	if suffix == "" {
+		return "", fmt.Errorf("state secret suffix template %q renders to an empty suffix", tmpl)
+	}
+	if len(suffix) > validation.LabelValueMaxLength {
+		return "", fmt.Errorf("state secret suffix %s exceeds %d characters", suffix, validation.LabelValueMaxLength)
+	}
+	return suffix, nil
+}
+
+// parseStateLabels parses labels given as key=value.
+func parseStateLabels(values []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, v := range values {
+		key, value, found := strings.Cut(v, "=")
+		if !found {
+			return nil, fmt.Errorf("state label '%s' must be given as key=value", v)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("state label key '%s' is invalid: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return nil, fmt.Errorf("state label value '%s' is invalid: %s", value, strings.Join(errs, ", "))
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRenderBackend(t *testing.T) {
+	tests := map[string]struct {
+		stateNamespace string
+		stateLabels    map[string]string
+		kubeconfigPath string
+		kubeContext    string
+		want           string
+	}{
+		"in cluster": {
+			want: `// File is generated; DO NOT EDIT.
+
+terraform {
+    backend "kubernetes" {
+        secret_suffix = "foo-dev"
+        namespace = "foo-cd"
+        in_cluster_config = true
+    }
+}`,
+		},
+		"state namespace": {
+			stateNamespace: "foo-prod-state",
+			want: `// File is generated; DO NOT EDIT.
+
+terraform {
+    backend "kubernetes" {
+        secret_suffix = "foo-dev"
+        namespace = "foo-prod-state"
+        in_cluster_config = true
+    }
+}`,
+		},
+		"labels": {
+			stateLabels: map[string]string{"team": "a", "app.kubernetes.io/part-of": "foo"},
+			want: `// File is generated; DO NOT EDIT.
+
+terraform {
+    backend "kubernetes" {
+        secret_suffix = "foo-dev"
+        namespace = "foo-cd"
+        labels = {
+            "app.kubernetes.io/part-of" = "foo"
+            "team" = "a"
+        }
+        in_cluster_config = true
+    }
+}`,
+		},
+		"kubeconfig": {
+			kubeconfigPath: "/home/dev/.kube/config",
+			kubeContext:    "my-cluster",
+			want: `// File is generated; DO NOT EDIT.
+
+terraform {
+    backend "kubernetes" {
+        secret_suffix = "foo-dev"
+        namespace = "foo-cd"
+        config_path = "/home/dev/.kube/config"
+        config_context = "my-cluster"
+    }
+}`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &options{terraformDir: dir, targetEnvironment: "dev", stateNamespace: tc.stateNamespace, backend: backendKubernetes}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Component: "foo", Namespace: "foo-cd"}
+			d.stateLabels = tc.stateLabels
+			d.kubeconfigPath = tc.kubeconfigPath
+			d.kubeContext = tc.kubeContext
+			if err := d.renderBackend(backendKubernetes, dir, "foo-dev"); err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "backend-kubernetes.tf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRenderBackendClashesWithConfigFile(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"terraform/main.tf":       `variable "a" {}`,
+		"terraform/backend-s3.tf": `resource "aws_s3_bucket" "state" {}`,
+	})
+	workDir, err := overlayDir(root, filepath.Join(root, "terraform"), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{terraformDir: workDir, s3Bucket: "tfstate"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Component: "foo", Namespace: "foo-cd"}
+	for _, backend := range []string{backendKubernetes, backendS3} {
+		err := d.renderBackend(backend, workDir, "foo-dev")
+		want := "backend-s3.tf of the terraform configuration clashes with the backend configuration generated by this task, rename it"
+		if err == nil || err.Error() != want {
+			t.Fatalf("want err: %s, got: %v", want, err)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(root, "terraform", "backend-s3.tf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `resource "aws_s3_bucket" "state" {}` {
+		t.Fatalf("want checkout untouched, got %s", got)
+	}
+}
+
+func TestRenderBackendS3(t *testing.T) {
+	dir := t.TempDir()
+	opts := &options{terraformDir: dir, s3Bucket: "tfstate", s3KeyPrefix: "ods", s3Region: "eu-west-1"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Component: "foo", Namespace: "foo-cd"}
+	if err := d.renderBackend(backendKubernetes, dir, "foo-dev"); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if err := d.renderBackend(backendS3, dir, "foo-dev"); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "backend-kubernetes.tf")); !os.IsNotExist(err) {
+		t.Fatalf("want kubernetes backend removed, got %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "backend-s3.tf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `// File is generated; DO NOT EDIT.
+
+terraform {
+    backend "s3" {
+        bucket = "tfstate"
+        key = "ods/foo-dev/terraform.tfstate"
+        region = "eu-west-1"
+        encrypt = true
+    }
+}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	d.opts.s3Bucket = ""
+	if err := d.renderBackend(backendS3, dir, "foo-dev"); err == nil {
+		t.Fatal("want err without bucket, got none")
+	}
+}
+
+func TestStateSecretSuffix(t *testing.T) {
+	tests := map[string]struct {
+		template     string
+		subrepo      string
+		terraformDir string
+		want         string
+		wantErr      bool
+	}{
+		"default": {
+			template: defaultStateSecretSuffix,
+			want:     "foo-dev",
+		},
+		"project and repository": {
+			template: "{{.Project}}-{{.Repository}}-{{.Component}}-{{.Environment}}",
+			want:     "proj-proj-foo-foo-dev",
+		},
+		"terraform dir is sanitized": {
+			template:     "{{.Component}}-{{.TerraformDir}}-{{.Environment}}",
+			terraformDir: "./infra/Network",
+			want:         "foo-infra-network-dev",
+		},
+		"subrepo": {
+			template:     defaultSubrepoStateSecretSuffix,
+			subrepo:      "Bar",
+			terraformDir: "./terraform",
+			want:         "foo-bar-terraform-dev",
+		},
+		"unknown field": {
+			template: "{{.Team}}",
+			wantErr:  true,
+		},
+		"empty": {
+			template: "{{.Subrepo}}",
+			wantErr:  true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := &options{targetEnvironment: "dev"}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Project: "proj", Repository: "proj-foo", Component: "foo"}
+			tfConfig := terraformConfig{relDir: tc.terraformDir}
+			if tc.subrepo != "" {
+				tfConfig.subrepo = subrepoEntry(t, tc.subrepo)
+			}
+			got, err := d.stateSecretSuffix(tc.template, tfConfig)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want: %s, got: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseStateLabels(t *testing.T) {
+	got, err := parseStateLabels([]string{"team=a", "app.kubernetes.io/part-of=foo"})
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := map[string]string{"team": "a", "app.kubernetes.io/part-of": "foo"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	for _, v := range []string{"team", "te am=a", "team=a b"} {
+		if _, err := parseStateLabels([]string{v}); err == nil {
+			t.Fatalf("want err for %s, got none", v)
+		}
+	}
+}
+
+func TestNewClientsetFromKubeconfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: a
+  cluster:
+    server: https://a.example.com
+- name: b
+  cluster:
+    server: https://b.example.com
+contexts:
+- name: a
+  context:
+    cluster: a
+- name: b
+  context:
+    cluster: b
+current-context: a
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		kubeContext string
+		wantContext string
+	}{
+		"current context": {wantContext: "a"},
+		"given context":   {kubeContext: "b", wantContext: "b"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset, configPath, configContext, err := newClientset(kubeconfig, tc.kubeContext)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if clientset == nil {
+				t.Fatal("want clientset, got nil")
+			}
+			if configPath != kubeconfig {
+				t.Fatalf("want config path %s, got %s", kubeconfig, configPath)
+			}
+			if configContext != tc.wantContext {
+				t.Fatalf("want context %s, got %s", tc.wantContext, configContext)
+			}
+		})
+	}
+}
+
+// subrepoEntry returns a directory entry for a subrepo called name.
+func subrepoEntry(t *testing.T, name string) fs.DirEntry {
+	reposDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(reposDir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries[0]
+}
+
+func TestSetupStateSecret(t *testing.T) {
+	opts := &options{
+		terraformDir:             "./terraform",
+		targetEnvironment:        "dev",
+		stateSecretSuffix:        defaultStateSecretSuffix,
+		subrepoStateSecretSuffix: defaultSubrepoStateSecretSuffix,
+	}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Component: "foo"}
+	d.tfConfigs = []terraformConfig{
+		{terraformDir: "terraform", relDir: "terraform"},
+		{terraformDir: ".ods/repos/bar/terraform", relDir: "terraform", subrepo: subrepoEntry(t, "bar")},
+	}
+	d, err := setupStateSecret()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	got := []string{d.tfConfigs[0].secretSuffix, d.tfConfigs[1].secretSuffix}
+	if diff := cmp.Diff([]string{"foo-dev", "foo-bar-terraform-dev"}, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	d.opts.subrepoStateSecretSuffix = defaultStateSecretSuffix
+	if _, err := setupStateSecret()(d); err == nil {
+		t.Fatal("want err for shared state secret suffix, got none")
+	}
+}
+
+func TestSetupStateSecretMultipleTerraformConfigs(t *testing.T) {
+	wsDir := writeFiles(t, map[string]string{
+		"terraform/main.tf":     `resource "null_resource" "a" {}`,
+		"infra/dns/main.tf":     `resource "null_resource" "a" {}`,
+		"infra/network/main.tf": `resource "null_resource" "a" {}`,
+	})
+	chdir(t, wsDir)
+	opts := defaultOptions
+	opts.terraformDir = "terraform\ninfra/*"
+	d := deployTerraformFromOptions(&opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", Component: "foo"}
+	d.clientset = fake.NewSimpleClientset()
+	d, err := locateTerraformConfigs()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	d, err = setupStateSecret()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	got := []string{}
+	for _, tfConfig := range d.tfConfigs {
+		got = append(got, tfConfig.secretSuffix)
+	}
+	want := []string{"foo-dev", "foo-infra-dns-dev", "foo-infra-network-dev"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	d.opts.terraformDir = "infra/dns"
+	d, err = locateTerraformConfigs()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	d, err = setupStateSecret()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if got := d.tfConfigs[0].secretSuffix; got != "foo-infra-dns-dev" {
+		t.Fatalf("want suffix of single config to depend on its dir only, got %s", got)
+	}
+
+	d.clientset = fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kubernetes.StateSecretName("default", "foo-dev"),
+			Namespace: "foo-cd",
+			Labels: map[string]string{
+				kubernetes.StateLabel:             "true",
+				kubernetes.StateSecretSuffixLabel: "foo-dev",
+				kubernetes.StateWorkspaceLabel:    "default",
+			},
+		},
+	})
+	d, err = setupStateSecret()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if got := d.tfConfigs[0].secretSuffix; got != "foo-dev" {
+		t.Fatalf("want previous suffix kept while state exists only under it, got %s", got)
+	}
+
+	d.opts.terraformDir = "infra/*"
+	d, err = locateTerraformConfigs()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	_, err = setupStateSecret()(d)
+	wantErr := "state with the previous suffix foo-dev exists, but neither infra/dns nor infra/network has state of its own: run only the config it belongs to with migrate-state-from set to {{.Component}}-{{.Environment}}"
+	if err == nil || err.Error() != wantErr {
+		t.Fatalf("want err: %s, got: %v", wantErr, err)
+	}
+
+	d.opts.terraformDir = "infra/dns"
+	d, err = locateTerraformConfigs()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	d.opts.migrateStateFrom = defaultStateSecretSuffix
+	d, err = setupStateSecret()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	d, err = migrateStateSecrets()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	moved, err := kubernetes.ListStateSecrets(d.clientset, "foo-cd", "foo-infra-dns-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 1 {
+		t.Fatalf("want legacy state moved, got %d state secrets", len(moved))
+	}
+}
+
+func TestSetupStateSecretMigration(t *testing.T) {
+	tests := map[string]struct {
+		mode       string
+		planOnly   bool
+		wantSuffix string
+		wantMoved  bool
+	}{
+		"apply":      {mode: modePlanApply, wantSuffix: "proj-repo-foo-dev", wantMoved: true},
+		"apply plan": {mode: modeApplyPlan, wantSuffix: "proj-repo-foo-dev", wantMoved: true},
+		"plan only":  {mode: modePlanApply, planOnly: true, wantSuffix: "foo-dev"},
+		"mode plan":  {mode: modePlan, wantSuffix: "foo-dev"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      kubernetes.StateSecretName("default", "foo-dev"),
+					Namespace: "foo-cd",
+					Labels: map[string]string{
+						kubernetes.StateLabel:             "true",
+						kubernetes.StateSecretSuffixLabel: "foo-dev",
+						kubernetes.StateWorkspaceLabel:    "default",
+					},
+				},
+			})
+			opts := &options{
+				targetEnvironment: "dev",
+				stateSecretSuffix: "{{.Project}}-{{.Repository}}-{{.Component}}-{{.Environment}}",
+				migrateStateFrom:  defaultStateSecretSuffix,
+				mode:              tc.mode,
+				planOnly:          tc.planOnly,
+			}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", Project: "proj", Repository: "repo", Component: "foo"}
+			d.clientset = clientset
+			d.tfConfigs = []terraformConfig{{terraformDir: "terraform", relDir: "terraform"}}
+			d, err := setupStateSecret()(d)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			// State is planned (and applied) against the previous suffix
+			// and only moved afterwards.
+			if got := d.tfConfigs[0].secretSuffix; got != "foo-dev" {
+				t.Fatalf("want suffix foo-dev before migration, got %s", got)
+			}
+			if moved, err := kubernetes.ListStateSecrets(clientset, "foo-cd", "proj-repo-foo-dev"); err != nil || len(moved) > 0 {
+				t.Fatalf("want state not moved before applying, got %d secrets, err %v", len(moved), err)
+			}
+			d, err = migrateStateSecrets()(d)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if got := d.tfConfigs[0].secretSuffix; got != tc.wantSuffix {
+				t.Fatalf("want suffix %s, got %s", tc.wantSuffix, got)
+			}
+			moved, err := kubernetes.ListStateSecrets(clientset, "foo-cd", "proj-repo-foo-dev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotMoved := len(moved) > 0; gotMoved != tc.wantMoved {
+				t.Fatalf("want moved %v, got %v", tc.wantMoved, gotMoved)
+			}
+		})
+	}
+}
+
+func TestSetupStateSecretMigrationStateWithBothSuffixes(t *testing.T) {
+	stateSecret := func(suffix string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      kubernetes.StateSecretName("default", suffix),
+				Namespace: "foo-cd",
+				Labels: map[string]string{
+					kubernetes.StateLabel:             "true",
+					kubernetes.StateSecretSuffixLabel: suffix,
+					kubernetes.StateWorkspaceLabel:    "default",
+				},
+			},
+		}
+	}
+	opts := &options{
+		targetEnvironment: "dev",
+		stateSecretSuffix: "{{.Repository}}-{{.Environment}}",
+		migrateStateFrom:  defaultStateSecretSuffix,
+		mode:              modePlanApply,
+	}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", Repository: "repo", Component: "foo"}
+	d.clientset = fake.NewSimpleClientset(stateSecret("foo-dev"), stateSecret("repo-dev"))
+	d.tfConfigs = []terraformConfig{{terraformDir: "terraform", relDir: "terraform"}}
+	_, err := setupStateSecret()(d)
+	wantErr := "cannot migrate state from suffix foo-dev to repo-dev: state exists with both suffixes"
+	if err == nil || err.Error() != wantErr {
+		t.Fatalf("want err: %s, got: %v", wantErr, err)
+	}
+}
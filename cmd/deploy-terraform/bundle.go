@@ -0,0 +1,582 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+const (
+	// planFile is the name of the saved plan in the work dir.
+	planFile = "tfplan"
+	// planBundleManifestFile is the name of the manifest in a plan bundle.
+	planBundleManifestFile = "manifest.json"
+	// planBundlesDir is the artifact directory holding the plan bundles.
+	planBundlesDir = "terraform-plans"
+)
+
+// planBundlesPath is the location of the plan bundles, which are stored and
+// fetched like all other artifacts of a pipeline run. As a saved plan holds
+// the values of all (including sensitive) variables in plaintext, the bundles
+// are encrypted with the key from kubernetes.PlanKeySecretName.
+var planBundlesPath = filepath.Join(pipelinectxt.ArtifactsPath, planBundlesDir)
+
+// planBundleManifest describes a plan bundle and the circumstances under
+// which the plan was computed.
+type planBundleManifest struct {
+	TerraformDir     string `json:"terraformDir"`
+	GitCommitSHA     string `json:"gitCommitSHA"`
+	TerraformVersion string `json:"terraformVersion"`
+	StateLineage     string `json:"stateLineage"`
+	StateSerial      int    `json:"stateSerial"`
+	PlanSummary      string `json:"planSummary"`
+	DestroyCount     int    `json:"destroyCount"`
+	// Providers holds the providers of the dependency lock file by their
+	// source address.
+	Providers map[string]providerLock `json:"providers"`
+	// Checksums holds the SHA-256 checksum of each file of the bundle.
+	Checksums map[string]string `json:"checksums"`
+}
+
+// planBundleFiles returns the files of workDir which make up a plan bundle:
+// the saved plan, the dependency lock file and the installed modules.
+// Providers are installed again by terraform init according to the lock
+// file.
+func planBundleFiles(workDir string) ([]string, error) {
+	files := []string{planFile}
+	if _, err := os.Stat(filepath.Join(workDir, ".terraform.lock.hcl")); err == nil {
+		files = append(files, ".terraform.lock.hcl")
+	}
+	modulesDir := filepath.Join(workDir, ".terraform", "modules")
+	err := filepath.WalkDir(modulesDir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == modulesDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(workDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+func sha256Sum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// encryptPlanBundle encrypts content with AES-GCM using key. The random
+// nonce is prepended to the result.
+func encryptPlanBundle(content, key []byte) ([]byte, error) {
+	gcm, err := planBundleCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, content, nil), nil
+}
+
+// decryptPlanBundle reverses encryptPlanBundle. It fails if content was not
+// encrypted with key or has been modified since.
+func decryptPlanBundle(content, key []byte) ([]byte, error) {
+	gcm, err := planBundleCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < gcm.NonceSize() {
+		return nil, fmt.Errorf("content too short")
+	}
+	nonce, ciphertext := content[:gcm.NonceSize()], content[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func planBundleCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writePlanBundle writes the bundle files of workDir together with the
+// manifest (to which their checksums are added) as gzipped tar, encrypted
+// with key, to file.
+func writePlanBundle(file, workDir string, manifest planBundleManifest, key []byte) error {
+	files, err := planBundleFiles(workDir)
+	if err != nil {
+		return fmt.Errorf("collect plan bundle files: %w", err)
+	}
+	contents := map[string][]byte{}
+	manifest.Checksums = map[string]string{}
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(f)))
+		if err != nil {
+			return fmt.Errorf("read %s: %w", f, err)
+		}
+		contents[f] = content
+		manifest.Checksums[f] = sha256Sum(content)
+	}
+	m, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	add := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+	if err := add(planBundleManifestFile, m); err != nil {
+		return fmt.Errorf("add manifest: %w", err)
+	}
+	for _, f := range files {
+		if err := add(f, contents[f]); err != nil {
+			return fmt.Errorf("add %s: %w", f, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	encrypted, err := encryptPlanBundle(b.Bytes(), key)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, encrypted, 0644)
+}
+
+// readPlanBundle decrypts the plan bundle file with key and extracts it into
+// workDir after verifying the checksums of its files against the manifest,
+// which is returned.
+func readPlanBundle(file, workDir string, key []byte) (*planBundleManifest, error) {
+	encrypted, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content, err := decryptPlanBundle(encrypted, key)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	tr := tar.NewReader(gr)
+	var manifest *planBundleManifest
+	contents := map[string][]byte{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+		name := filepath.ToSlash(filepath.Clean(h.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid file name %s", h.Name)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		if name == planBundleManifestFile {
+			manifest = &planBundleManifest{}
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, fmt.Errorf("parse manifest: %w", err)
+			}
+			continue
+		}
+		contents[name] = content
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("no %s found", planBundleManifestFile)
+	}
+	if _, ok := manifest.Checksums[planFile]; !ok {
+		return nil, fmt.Errorf("no %s found", planFile)
+	}
+	mismatches := []string{}
+	for name, want := range manifest.Checksums {
+		content, ok := contents[name]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s is missing", name))
+		} else if got := sha256Sum(content); got != want {
+			mismatches = append(mismatches, fmt.Sprintf("%s has checksum %s instead of %s", name, got, want))
+		}
+	}
+	for name := range contents {
+		if _, ok := manifest.Checksums[name]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s is not listed in manifest", name))
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return nil, fmt.Errorf("checksum verification failed: %s", strings.Join(mismatches, "; "))
+	}
+	for name, content := range contents {
+		target := filepath.Join(workDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		// The work dir may link to the file in the repository (e.g. the
+		// dependency lock file), which must not be overwritten.
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := os.WriteFile(target, content, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// noChangesMarker records that the plan of a terraform config had no
+// changes, so that a missing plan bundle can be told apart from a lost one.
+type noChangesMarker struct {
+	TerraformDir string `json:"terraformDir"`
+	GitCommitSHA string `json:"gitCommitSHA"`
+}
+
+// planBundleName returns the name of the plan bundle of tfConfig, without
+// extension.
+func planBundleName(tfConfig terraformConfig) string {
+	name := tfConfig.artifactName
+	if tfConfig.subrepo != nil {
+		name = tfConfig.subrepo.Name() + "-" + name
+	}
+	return name
+}
+
+// planBundlePath returns the location of the plan bundle of tfConfig.
+func planBundlePath(tfConfig terraformConfig) string {
+	return filepath.Join(planBundlesPath, planBundleName(tfConfig)+".tar.gz.enc")
+}
+
+// noChangesMarkerPath returns the location of the marker recording that the
+// plan of tfConfig had no changes.
+func noChangesMarkerPath(tfConfig terraformConfig) string {
+	return filepath.Join(planBundlesPath, planBundleName(tfConfig)+".no-changes.json")
+}
+
+// writeNoChangesMarker writes marker to file.
+func writeNoChangesMarker(file string, marker noChangesMarker) error {
+	m, err := json.MarshalIndent(marker, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode marker: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, m, 0644)
+}
+
+// readNoChangesMarker reads the marker from file.
+func readNoChangesMarker(file string) (*noChangesMarker, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	marker := &noChangesMarker{}
+	if err := json.Unmarshal(content, marker); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+	return marker, nil
+}
+
+// planKey returns the key with which plan bundles are encrypted, creating it
+// if create is set and it does not exist yet.
+func (d *deployTerraform) planKey(create bool) ([]byte, error) {
+	if d.planBundleKey == nil {
+		key, err := kubernetes.GetPlanKey(d.clientset, d.ctxt.Namespace, create)
+		if err != nil {
+			return nil, fmt.Errorf("get plan bundle key from secret %s: %w", kubernetes.PlanKeySecretName, err)
+		}
+		d.planBundleKey = key
+	}
+	return d.planBundleKey, nil
+}
+
+// stateVersion returns the lineage and the serial of the state of the
+// selected workspace. Both are empty if there is no state yet.
+func (d *deployTerraform) stateVersion(dir string) (string, int, error) {
+	args, env, sensitive, err := d.assembleStatePullArgsEnv()
+	if err != nil {
+		return "", 0, fmt.Errorf("assemble terraform state pull args/env: %w", err)
+	}
+	printlnTerraformCmd(args, env, sensitive, dir, d.outWriter)
+	var out bytes.Buffer
+	if err := d.terraformCmd(args, env, dir, &out, d.errWriter); err != nil {
+		return "", 0, fmt.Errorf("terraform state pull: %w", err)
+	}
+	if len(bytes.TrimSpace(out.Bytes())) == 0 {
+		return "", 0, nil
+	}
+	var state struct {
+		Lineage string `json:"lineage"`
+		Serial  int    `json:"serial"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &state); err != nil {
+		return "", 0, fmt.Errorf("parse state: %w", err)
+	}
+	return state.Lineage, state.Serial, nil
+}
+
+// terraformVersion returns the version of the terraform binary.
+func (d *deployTerraform) terraformVersion(dir string) (string, error) {
+	var out bytes.Buffer
+	if err := d.terraformCmd([]string{"version", "-json"}, d.commonTerraformEnv(), dir, &out, d.errWriter); err != nil {
+		return "", fmt.Errorf("terraform version: %w", err)
+	}
+	var version struct {
+		TerraformVersion string `json:"terraform_version"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &version); err != nil {
+		return "", fmt.Errorf("parse terraform version: %w", err)
+	}
+	return version.TerraformVersion, nil
+}
+
+// currentPlanBundleManifest returns a manifest describing the circumstances
+// under which a plan is computed (or applied) in the work dir of tfConfig.
+func (d *deployTerraform) currentPlanBundleManifest(tfConfig terraformConfig) (*planBundleManifest, error) {
+	version, err := d.terraformVersion(tfConfig.workDir)
+	if err != nil {
+		return nil, err
+	}
+	lineage, serial, err := d.stateVersion(tfConfig.workDir)
+	if err != nil {
+		return nil, fmt.Errorf("determine state version: %w", err)
+	}
+	lockFile, err := os.ReadFile(filepath.Join(tfConfig.workDir, ".terraform.lock.hcl"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read dependency lock file: %w", err)
+	}
+	providers, err := parseLockFile(string(lockFile))
+	if err != nil {
+		return nil, fmt.Errorf("parse dependency lock file: %w", err)
+	}
+	return &planBundleManifest{
+		TerraformDir:     tfConfig.terraformDir,
+		GitCommitSHA:     d.ctxt.GitCommitSHA,
+		TerraformVersion: version,
+		StateLineage:     lineage,
+		StateSerial:      serial,
+		Providers:        providers,
+	}, nil
+}
+
+// planBundleFileMismatches lists the files of the plan bundle which differ
+// in workDir from the checksums recorded in manifest, e.g. because terraform
+// init changed the dependency lock file or the installed modules.
+func planBundleFileMismatches(workDir string, manifest *planBundleManifest) ([]string, error) {
+	files, err := planBundleFiles(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("collect plan bundle files: %w", err)
+	}
+	mismatches := []string{}
+	present := map[string]bool{}
+	for _, f := range files {
+		content, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(f)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", f, err)
+		}
+		present[f] = true
+		want, ok := manifest.Checksums[f]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s was added", f))
+		} else if sha256Sum(content) != want {
+			mismatches = append(mismatches, fmt.Sprintf("%s was changed", f))
+		}
+	}
+	for f := range manifest.Checksums {
+		if !present[f] {
+			mismatches = append(mismatches, fmt.Sprintf("%s was removed", f))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches, nil
+}
+
+// planBundleMismatches lists the differences between the circumstances
+// under which the plan was computed and the current ones which make
+// applying the plan unsafe.
+func planBundleMismatches(planned, current *planBundleManifest) []string {
+	mismatches := []string{}
+	if current.GitCommitSHA != planned.GitCommitSHA {
+		mismatches = append(mismatches, fmt.Sprintf("git commit is %s instead of %s", current.GitCommitSHA, planned.GitCommitSHA))
+	}
+	if current.TerraformVersion != planned.TerraformVersion {
+		mismatches = append(mismatches, fmt.Sprintf("terraform version is %s instead of %s", current.TerraformVersion, planned.TerraformVersion))
+	}
+	if current.StateLineage != planned.StateLineage {
+		mismatches = append(mismatches, fmt.Sprintf("state lineage is %q instead of %q", current.StateLineage, planned.StateLineage))
+	} else if current.StateSerial != planned.StateSerial {
+		mismatches = append(mismatches, fmt.Sprintf("state serial is %d instead of %d", current.StateSerial, planned.StateSerial))
+	}
+	return append(mismatches, providerLockMismatches(planned.Providers, current.Providers)...)
+}
+
+// savePlanBundles stores the saved plan of each terraform config with
+// changes in a plan bundle, to be applied by a later task run in mode
+// apply-plan. For configs without changes, a no-changes marker is written
+// instead.
+func savePlanBundles() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		for _, tfConfig := range d.tfConfigs {
+			if !tfConfig.hasChanges {
+				file := noChangesMarkerPath(tfConfig)
+				marker := noChangesMarker{TerraformDir: tfConfig.terraformDir, GitCommitSHA: d.ctxt.GitCommitSHA}
+				if err := writeNoChangesMarker(file, marker); err != nil {
+					return d, fmt.Errorf("write no-changes marker of %s: %w", tfConfig.terraformDir, err)
+				}
+				d.logger.Infof("No changes detected in %s, recorded as %s.", tfConfig.terraformDir, file)
+				continue
+			}
+			manifest, err := d.currentPlanBundleManifest(tfConfig)
+			if err != nil {
+				return d, fmt.Errorf("describe plan of %s: %w", tfConfig.terraformDir, err)
+			}
+			manifest.PlanSummary = tfConfig.planSummary
+			manifest.DestroyCount = tfConfig.destroyCount
+			key, err := d.planKey(true)
+			if err != nil {
+				return d, err
+			}
+			file := planBundlePath(tfConfig)
+			if err := writePlanBundle(file, tfConfig.workDir, *manifest, key); err != nil {
+				return d, fmt.Errorf("write plan bundle of %s: %w", tfConfig.terraformDir, err)
+			}
+			d.logger.Infof(
+				"Saved plan bundle of %s as %s (terraform %s, state serial %d).",
+				tfConfig.terraformDir, file, manifest.TerraformVersion, manifest.StateSerial,
+			)
+		}
+		return d, &skipRemainingSteps{"Plan bundles saved, apply them with mode apply-plan."}
+	}
+}
+
+// restorePlanBundles extracts the plan bundle of each terraform config into
+// its work dir. Configs without plan bundle must have a no-changes marker,
+// as the plan bundle might have been lost otherwise.
+func restorePlanBundles() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if d.opts.planOnly {
+			return d, &skipRemainingSteps{"Only planning was requested, not applying plan bundles."}
+		}
+		restored := 0
+		for i, tfConfig := range d.tfConfigs {
+			file := planBundlePath(tfConfig)
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				markerFile := noChangesMarkerPath(tfConfig)
+				marker, err := readNoChangesMarker(markerFile)
+				if os.IsNotExist(err) {
+					return d, fmt.Errorf("neither plan bundle %s nor no-changes marker %s found for %s, plan again", file, markerFile, tfConfig.terraformDir)
+				}
+				if err != nil {
+					return d, fmt.Errorf("read no-changes marker %s: %w", markerFile, err)
+				}
+				if marker.GitCommitSHA != d.ctxt.GitCommitSHA {
+					return d, fmt.Errorf("no-changes marker %s was created for git commit %s, not %s", markerFile, marker.GitCommitSHA, d.ctxt.GitCommitSHA)
+				}
+				d.logger.Infof("No changes were planned in %s, skipping.", tfConfig.terraformDir)
+				continue
+			}
+			key, err := d.planKey(false)
+			if err != nil {
+				return d, err
+			}
+			manifest, err := readPlanBundle(file, tfConfig.workDir, key)
+			if err != nil {
+				return d, fmt.Errorf("read plan bundle %s: %w", file, err)
+			}
+			if manifest.GitCommitSHA != d.ctxt.GitCommitSHA {
+				return d, fmt.Errorf("plan bundle %s was created for git commit %s, not %s", file, manifest.GitCommitSHA, d.ctxt.GitCommitSHA)
+			}
+			d.tfConfigs[i].planManifest = manifest
+			d.tfConfigs[i].hasChanges = true
+			d.tfConfigs[i].savedPlan = true
+			d.tfConfigs[i].planSummary = manifest.PlanSummary
+			d.tfConfigs[i].destroyCount = manifest.DestroyCount
+			d.logger.Infof("Restored plan bundle %s: %s", file, manifest.PlanSummary)
+			restored++
+		}
+		if restored == 0 {
+			if err := d.migrateStateSecrets(); err != nil {
+				return d, err
+			}
+			return d, &skipRemainingSteps{"No changes were planned, skipping terraform apply."}
+		}
+		return d, nil
+	}
+}
+
+// verifyPlanBundles checks that neither the git commit, the terraform
+// version, the state nor the providers have changed since the plan of each
+// restored plan bundle was computed, and that terraform init left the
+// restored files untouched.
+func verifyPlanBundles() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		for _, tfConfig := range d.tfConfigs {
+			if tfConfig.planManifest == nil {
+				continue
+			}
+			current, err := d.currentPlanBundleManifest(tfConfig)
+			if err != nil {
+				return d, fmt.Errorf("describe current state of %s: %w", tfConfig.terraformDir, err)
+			}
+			fileMismatches, err := planBundleFileMismatches(tfConfig.workDir, tfConfig.planManifest)
+			if err != nil {
+				return d, fmt.Errorf("verify plan bundle files of %s: %w", tfConfig.terraformDir, err)
+			}
+			mismatches := append(planBundleMismatches(tfConfig.planManifest, current), fileMismatches...)
+			if len(mismatches) > 0 {
+				return d, fmt.Errorf(
+					"plan of %s is outdated, plan again: %s",
+					tfConfig.terraformDir, strings.Join(mismatches, "; "),
+				)
+			}
+		}
+		d.logger.Infof("Plan bundles match git commit %s, terraform version, state and providers.", d.ctxt.GitCommitSHA)
+		return d, nil
+	}
+}
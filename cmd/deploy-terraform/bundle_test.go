@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlanBundleRoundTrip(t *testing.T) {
+	workDir := writeFiles(t, map[string]string{
+		planFile:                              "plan",
+		".terraform.lock.hcl":                 "lock",
+		".terraform/modules/modules.json":     "{}",
+		".terraform/modules/vpc/main.tf":      "vpc",
+		".terraform/providers/registry/p/foo": "provider",
+		"main.tf":                             "config",
+	})
+	file := filepath.Join(t.TempDir(), "plan-dev.tar.gz")
+	err := writePlanBundle(file, workDir, planBundleManifest{GitCommitSHA: "abc", StateSerial: 3}, testPlanKey)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+
+	target := writeFiles(t, map[string]string{"main.tf": "config"})
+	manifest, err := readPlanBundle(file, target, testPlanKey)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if manifest.GitCommitSHA != "abc" || manifest.StateSerial != 3 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	wantFiles := []string{".terraform.lock.hcl", ".terraform/modules/modules.json", ".terraform/modules/vpc/main.tf", planFile}
+	gotFiles := []string{}
+	for f := range manifest.Checksums {
+		gotFiles = append(gotFiles, f)
+		if _, err := os.Stat(filepath.Join(target, f)); err != nil {
+			t.Fatalf("want %s extracted, got %s", f, err)
+		}
+	}
+	if diff := cmp.Diff(wantFiles, gotFiles, cmpSorted); diff != "" {
+		t.Fatalf("files mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPlanBundleEncrypted(t *testing.T) {
+	workDir := writeFiles(t, map[string]string{planFile: "secret-value"})
+	file := filepath.Join(t.TempDir(), "plan-dev.tar.gz.enc")
+	if err := writePlanBundle(file, workDir, planBundleManifest{}, testPlanKey); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gzip.NewReader(bytes.NewReader(content)); err == nil {
+		t.Fatal("want plan bundle not to be readable without key")
+	}
+	otherKey := bytes.Repeat([]byte{1}, kubernetes.PlanKeySize)
+	_, err = readPlanBundle(file, t.TempDir(), otherKey)
+	wantErr := "decrypt: cipher: message authentication failed"
+	if err == nil || err.Error() != wantErr {
+		t.Fatalf("want err: %s, got: %v", wantErr, err)
+	}
+}
+
+// testPlanKey is the key with which plan bundles are encrypted in tests.
+var testPlanKey = bytes.Repeat([]byte{0}, kubernetes.PlanKeySize)
+
+// testPlanKeySecret is the secret holding testPlanKey.
+var testPlanKeySecret = &corev1.Secret{
+	ObjectMeta: metav1.ObjectMeta{Name: kubernetes.PlanKeySecretName, Namespace: "foo-cd"},
+	Data:       map[string][]byte{kubernetes.PlanKeySecretKey: testPlanKey},
+}
+
+var cmpSorted = cmp.Transformer("sorted", func(s []string) []string {
+	sorted := append([]string{}, s...)
+	sort.Strings(sorted)
+	return sorted
+})
+
+// tarGz creates a gzipped tar containing files, encrypted with testPlanKey.
+func tarGz(t *testing.T, files map[string]string) string {
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := encryptPlanBundle(b.Bytes(), testPlanKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "bundle.tar.gz.enc")
+	if err := os.WriteFile(file, encrypted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadPlanBundleInvalid(t *testing.T) {
+	planSum := sha256Sum([]byte("plan"))
+	tests := map[string]struct {
+		files   map[string]string
+		wantErr string
+	}{
+		"modified plan": {
+			files: map[string]string{
+				planBundleManifestFile: `{"checksums": {"tfplan": "` + planSum + `"}}`,
+				planFile:               "other plan",
+			},
+			wantErr: "checksum verification failed: tfplan has checksum " + sha256Sum([]byte("other plan")) + " instead of " + planSum,
+		},
+		"added file": {
+			files: map[string]string{
+				planBundleManifestFile: `{"checksums": {"tfplan": "` + planSum + `"}}`,
+				planFile:               "plan",
+				"main.tf":              "injected",
+			},
+			wantErr: "checksum verification failed: main.tf is not listed in manifest",
+		},
+		"missing plan": {
+			files: map[string]string{
+				planBundleManifestFile: `{"checksums": {"tfplan": "` + planSum + `"}}`,
+			},
+			wantErr: "checksum verification failed: tfplan is missing",
+		},
+		"missing manifest": {
+			files:   map[string]string{planFile: "plan"},
+			wantErr: "no manifest.json found",
+		},
+		"path traversal": {
+			files:   map[string]string{"../main.tf": "injected"},
+			wantErr: "invalid file name ../main.tf",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := readPlanBundle(tarGz(t, tc.files), t.TempDir(), testPlanKey)
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyPlanBundles(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "terraform")
+	script := `#!/bin/sh
+case "$1 $2" in
+"version -json") echo '{"terraform_version": "1.5.7"}' ;;
+"state pull") echo '{"version": 4, "lineage": "0a1b", "serial": 7}' ;;
+esac
+`
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	lockFile := `provider "registry.terraform.io/hashicorp/null" {
+  version = "3.2.2"
+  hashes  = ["h1:abc=", "h1:def="]
+}
+`
+	aws := "registry.terraform.io/hashicorp/aws"
+	null := "registry.terraform.io/hashicorp/null"
+	planned := planBundleManifest{
+		GitCommitSHA:     "abc",
+		TerraformVersion: "1.5.7",
+		StateLineage:     "0a1b",
+		StateSerial:      7,
+		Providers:        map[string]providerLock{null: {Version: "3.2.2", Hashes: []string{"h1:abc="}}},
+		Checksums:        map[string]string{planFile: sha256Sum([]byte("plan")), ".terraform.lock.hcl": sha256Sum([]byte(lockFile))},
+	}
+	tests := map[string]struct {
+		modify  func(m *planBundleManifest)
+		files   map[string]string
+		wantErr string
+	}{
+		"unchanged": {
+			modify: func(m *planBundleManifest) {},
+		},
+		"state modified": {
+			modify:  func(m *planBundleManifest) { m.StateSerial = 6 },
+			wantErr: "plan of terraform is outdated, plan again: state serial is 7 instead of 6",
+		},
+		"state replaced": {
+			modify:  func(m *planBundleManifest) { m.StateLineage = "ffff"; m.StateSerial = 1 },
+			wantErr: `plan of terraform is outdated, plan again: state lineage is "0a1b" instead of "ffff"`,
+		},
+		"terraform and providers upgraded": {
+			modify: func(m *planBundleManifest) {
+				m.TerraformVersion = "1.5.6"
+				m.Providers = map[string]providerLock{null: {Version: "3.2.1"}, aws: {Version: "5.31.0"}}
+			},
+			wantErr: "plan of terraform is outdated, plan again: terraform version is 1.5.7 instead of 1.5.6; " +
+				"provider " + aws + " is no longer installed; provider " + null + " has version 3.2.2 instead of 3.2.1",
+		},
+		"other commit": {
+			modify:  func(m *planBundleManifest) { m.GitCommitSHA = "def" },
+			wantErr: "plan of terraform is outdated, plan again: git commit is abc instead of def",
+		},
+		"files changed by init": {
+			modify: func(m *planBundleManifest) {},
+			files: map[string]string{
+				".terraform.lock.hcl":             lockFile + "\n",
+				".terraform/modules/modules.json": "{}",
+			},
+			wantErr: "plan of terraform is outdated, plan again: .terraform.lock.hcl was changed; .terraform/modules/modules.json was added",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := deployTerraformFromOptions(&options{}, io.Discard, io.Discard)
+			d.terraformBin = bin
+			d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", GitCommitSHA: "abc"}
+			manifest := planned
+			tc.modify(&manifest)
+			files := map[string]string{planFile: "plan", ".terraform.lock.hcl": lockFile}
+			for f, content := range tc.files {
+				files[f] = content
+			}
+			d.tfConfigs = []terraformConfig{
+				{terraformDir: "terraform", workDir: writeFiles(t, files), planManifest: &manifest},
+				{terraformDir: "other", workDir: t.TempDir()},
+			}
+			_, err := verifyPlanBundles()(d)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("want no err, got %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSavePlanBundles(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "terraform")
+	script := `#!/bin/sh
+case "$1 $2" in
+"version -json") echo '{"terraform_version": "1.5.7"}' ;;
+"state pull") echo '{"version": 4, "lineage": "0a1b", "serial": 7}' ;;
+esac
+`
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, t.TempDir())
+	d := deployTerraformFromOptions(&options{}, io.Discard, io.Discard)
+	d.terraformBin = bin
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", GitCommitSHA: "abc"}
+	d.clientset = fake.NewSimpleClientset()
+	workDir := writeFiles(t, map[string]string{
+		planFile:              "plan",
+		".terraform.lock.hcl": "provider \"registry.terraform.io/hashicorp/null\" {\n  version = \"3.2.2\"\n  hashes = [\"h1:abc=\"]\n}\n",
+	})
+	tfConfig := terraformConfig{terraformDir: "terraform", artifactName: "plan-dev", workDir: workDir, hasChanges: true, planSummary: "Plan: 1 to add, 0 to change, 0 to destroy."}
+	d.tfConfigs = []terraformConfig{tfConfig, {terraformDir: "other", artifactName: "other-plan-dev"}}
+	_, err := savePlanBundles()(d)
+	if _, ok := err.(*skipRemainingSteps); !ok {
+		t.Fatalf("want remaining steps skipped, got %v", err)
+	}
+	if _, err := os.Stat(planBundlePath(d.tfConfigs[1])); !os.IsNotExist(err) {
+		t.Fatalf("want no plan bundle for config without changes, got %v", err)
+	}
+	marker, err := readNoChangesMarker(noChangesMarkerPath(d.tfConfigs[1]))
+	if err != nil {
+		t.Fatalf("want no-changes marker for config without changes, got %s", err)
+	}
+	if diff := cmp.Diff(&noChangesMarker{TerraformDir: "other", GitCommitSHA: "abc"}, marker); diff != "" {
+		t.Fatalf("marker mismatch (-want +got):\n%s", diff)
+	}
+	key, err := kubernetes.GetPlanKey(d.clientset, "foo-cd", false)
+	if err != nil {
+		t.Fatalf("want plan bundle key created, got %s", err)
+	}
+	got, err := readPlanBundle(planBundlePath(tfConfig), t.TempDir(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Checksums = nil
+	want := &planBundleManifest{
+		TerraformDir:     "terraform",
+		GitCommitSHA:     "abc",
+		TerraformVersion: "1.5.7",
+		StateLineage:     "0a1b",
+		StateSerial:      7,
+		PlanSummary:      "Plan: 1 to add, 0 to change, 0 to destroy.",
+		Providers:        map[string]providerLock{"registry.terraform.io/hashicorp/null": {Version: "3.2.2", Hashes: []string{"h1:abc="}}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("manifest mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRestorePlanBundles(t *testing.T) {
+	wsDir := t.TempDir()
+	chdir(t, wsDir)
+	workDir := writeFiles(t, map[string]string{planFile: "plan"})
+	tfConfig := terraformConfig{terraformDir: "terraform", artifactName: "plan-dev"}
+	err := writePlanBundle(planBundlePath(tfConfig), workDir, planBundleManifest{GitCommitSHA: "abc", PlanSummary: "Plan: 1 to add, 0 to change, 1 to destroy.", DestroyCount: 1}, testPlanKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := terraformConfig{terraformDir: "other", artifactName: "other-plan-dev"}
+	tests := map[string]struct {
+		commit       string
+		markerCommit string
+		wantErr      string
+	}{
+		"same commit":  {commit: "abc", markerCommit: "abc"},
+		"other commit": {commit: "def", markerCommit: "abc", wantErr: "plan bundle .ods/artifacts/terraform-plans/plan-dev.tar.gz.enc was created for git commit abc, not def"},
+		"no marker": {
+			commit:  "abc",
+			wantErr: "neither plan bundle .ods/artifacts/terraform-plans/other-plan-dev.tar.gz.enc nor no-changes marker .ods/artifacts/terraform-plans/other-plan-dev.no-changes.json found for other, plan again",
+		},
+		"marker of other commit": {
+			commit:       "abc",
+			markerCommit: "def",
+			wantErr:      "no-changes marker .ods/artifacts/terraform-plans/other-plan-dev.no-changes.json was created for git commit def, not abc",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			markerFile := noChangesMarkerPath(other)
+			if err := os.RemoveAll(markerFile); err != nil {
+				t.Fatal(err)
+			}
+			if tc.markerCommit != "" {
+				if err := writeNoChangesMarker(markerFile, noChangesMarker{TerraformDir: "other", GitCommitSHA: tc.markerCommit}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := deployTerraformFromOptions(&options{}, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd", GitCommitSHA: tc.commit}
+			d.clientset = fake.NewSimpleClientset(testPlanKeySecret)
+			other.workDir = t.TempDir()
+			tfConfig.workDir = t.TempDir()
+			d.tfConfigs = []terraformConfig{tfConfig, other}
+			_, err := restorePlanBundles()(d)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			restored := d.tfConfigs[0]
+			if !restored.hasChanges || restored.destroyCount != 1 || restored.planManifest == nil {
+				t.Fatalf("unexpected restored config: %+v", restored)
+			}
+			if d.tfConfigs[1].hasChanges {
+				t.Fatal("want config with no-changes marker to have no changes")
+			}
+			if _, err := os.Stat(filepath.Join(restored.workDir, planFile)); err != nil {
+				t.Fatalf("want plan extracted, got %s", err)
+			}
+		})
+	}
+}
+
+func TestStepsForMode(t *testing.T) {
+	for _, mode := range []string{modePlanApply, modePlan, modeApplyPlan} {
+		if _, err := stepsForMode(mode); err != nil {
+			t.Fatalf("want no err for mode %s, got %s", mode, err)
+		}
+	}
+	if _, err := stepsForMode("apply"); err == nil {
+		t.Fatal("want err for unknown mode, got none")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embed the time zone database as the image may not provide one.
+	_ "time/tzdata"
+)
+
+const (
+	// outsideChangeWindowFail fails the task when applying outside of the
+	// change windows.
+	outsideChangeWindowFail = "fail"
+	// outsideChangeWindowPlanOnly only plans when applying outside of the
+	// change windows.
+	outsideChangeWindowPlanOnly = "plan-only"
+)
+
+// weekdayNames maps the (abbreviated) names of weekdays to time.Weekday.
+var weekdayNames = map[string]time.Weekday{}
+
+func init() {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		weekdayNames[strings.ToLower(d.String())] = d
+		weekdayNames[strings.ToLower(d.String()[:3])] = d
+	}
+}
+
+// odsChangeWindow is a change window as given in ods.yaml, e.g. Mon-Thu from
+// 09:00 to 16:00 in time zone Europe/Berlin.
+type odsChangeWindow struct {
+	// Days are weekdays (Mon or Monday) or ranges of weekdays (Mon-Fri) on
+	// which the window starts. Empty means every day.
+	Days []string `json:"days"`
+	// Start is the time of day (HH:MM) at which the window opens.
+	Start string `json:"start"`
+	// End is the time of day (HH:MM, up to 24:00) at which the window
+	// closes. If it is before start, the window closes on the next day.
+	End string `json:"end"`
+	// TimeZone is the IANA name of the time zone of start and end. Empty
+	// means UTC.
+	TimeZone string `json:"timeZone"`
+}
+
+// changeWindow is a parsed odsChangeWindow.
+type changeWindow struct {
+	days     map[time.Weekday]bool
+	start    int // minutes since midnight
+	end      int // minutes since midnight
+	location *time.Location
+	text     string
+}
+
+// changeWindowList holds the change windows given as flag, one per line as
+// [<days>] <start>-<end> [<time zone>] with days separated by commas, e.g.
+// "Mon-Thu,Sat 09:00-16:00 Europe/Berlin". They are validated when the flag
+// is parsed.
+type changeWindowList []changeWindow
+
+func (l *changeWindowList) String() string {
+	windows := []string{}
+	for _, w := range *l {
+		windows = append(windows, w.String())
+	}
+	return strings.Join(windows, "\n")
+}
+
+func (l *changeWindowList) Set(value string) error {
+	for _, line := range strings.Split(value, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		w, err := parseChangeWindowLine(line)
+		if err != nil {
+			return fmt.Errorf("change window %q: %w", strings.TrimSpace(line), err)
+		}
+		cw, err := parseChangeWindow(w)
+		if err != nil {
+			return fmt.Errorf("change window %q: %w", strings.TrimSpace(line), err)
+		}
+		*l = append(*l, cw)
+	}
+	return nil
+}
+
+// parseChangeWindowLine parses a change window given as
+// [<days>] <start>-<end> [<time zone>].
+func parseChangeWindowLine(line string) (odsChangeWindow, error) {
+	w := odsChangeWindow{}
+	fields := strings.Fields(line)
+	times := -1
+	for i, f := range fields {
+		if strings.Contains(f, ":") {
+			times = i
+			break
+		}
+	}
+	if times < 0 || times > 1 || len(fields) > times+2 {
+		return w, fmt.Errorf("want [<days>] <start>-<end> [<time zone>]")
+	}
+	if times == 1 {
+		w.Days = strings.Split(fields[0], ",")
+	}
+	var ok bool
+	w.Start, w.End, ok = strings.Cut(fields[times], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid times %q, want <start>-<end>", fields[times])
+	}
+	if len(fields) > times+1 {
+		w.TimeZone = fields[times+1]
+	}
+	return w, nil
+}
+
+// parseChangeWindows parses the change windows of ods.yaml.
+func parseChangeWindows(windows []odsChangeWindow) ([]changeWindow, error) {
+	parsed := []changeWindow{}
+	for i, w := range windows {
+		cw, err := parseChangeWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("change window %d: %w", i+1, err)
+		}
+		parsed = append(parsed, cw)
+	}
+	return parsed, nil
+}
+
+func parseChangeWindow(w odsChangeWindow) (changeWindow, error) {
+	cw := changeWindow{days: map[time.Weekday]bool{}}
+	for _, d := range w.Days {
+		from, to, isRange := strings.Cut(d, "-")
+		first, err := parseWeekday(from)
+		if err != nil {
+			return cw, err
+		}
+		last := first
+		if isRange {
+			last, err = parseWeekday(to)
+			if err != nil {
+				return cw, err
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			cw.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	if len(w.Days) == 0 {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			cw.days[day] = true
+		}
+	}
+	var err error
+	if cw.start, err = parseTimeOfDay(w.Start); err != nil {
+		return cw, fmt.Errorf("start: %w", err)
+	}
+	if cw.end, err = parseTimeOfDay(w.End); err != nil {
+		return cw, fmt.Errorf("end: %w", err)
+	}
+	if cw.start == cw.end {
+		return cw, fmt.Errorf("start and end are both %s", w.Start)
+	}
+	if cw.location, err = time.LoadLocation(w.TimeZone); err != nil {
+		return cw, fmt.Errorf("time zone: %w", err)
+	}
+	days := "every day"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	cw.text = fmt.Sprintf("%s %s-%s %s", days, w.Start, w.End, cw.location)
+	return cw, nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	d, ok := weekdayNames[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return 0, fmt.Errorf("invalid weekday %q", s)
+	}
+	return d, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of HH:MM.
+func parseTimeOfDay(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if !ok || len(minutes) != 2 || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains returns whether t is within the change window.
+func (w changeWindow) contains(t time.Time) bool {
+	local := t.In(w.location)
+	minutes := local.Hour()*60 + local.Minute()
+	if w.start < w.end {
+		return w.days[local.Weekday()] && minutes >= w.start && minutes < w.end
+	}
+	// The window spans midnight: it is open from start on the day it
+	// starts and until end on the next day.
+	yesterday := (local.Weekday() + 6) % 7
+	return (w.days[local.Weekday()] && minutes >= w.start) || (w.days[yesterday] && minutes < w.end)
+}
+
+func (w changeWindow) String() string {
+	return w.text
+}
+
+// checkChangeWindow checks whether changes may be applied at the given time.
+// The time must be within one of the change windows given as flag, and
+// within one of the change windows of ods.yaml, which can therefore only
+// restrict further when changes are applied. Outside of the change windows
+// of the target environment, it fails or (with outside-change-window set to
+// plan-only) skips applying, unless an emergency change is requested, which
+// is logged together with its reason.
+func (d *deployTerraform) checkChangeWindow(now time.Time) error {
+	if d.opts.emergencyChange && strings.TrimSpace(d.opts.emergencyChangeReason) == "" {
+		return fmt.Errorf("emergency-change requires emergency-change-reason")
+	}
+	closed := []string{}
+	for _, windows := range [][]changeWindow{d.opts.changeWindows, d.changeWindows} {
+		open := false
+		for _, w := range windows {
+			if w.contains(now) {
+				d.logger.Infof("Applying within change window %s.", w)
+				open = true
+				break
+			}
+		}
+		if !open {
+			for _, w := range windows {
+				closed = append(closed, w.String())
+			}
+		}
+	}
+	if len(closed) == 0 {
+		return nil
+	}
+	outside := fmt.Sprintf(
+		"%s is outside of the change windows of target environment %s (%s)",
+		now.UTC().Format(time.RFC3339), d.opts.targetEnvironment, strings.Join(closed, "; "),
+	)
+	if d.opts.emergencyChange {
+		d.logger.Warnf("EMERGENCY CHANGE: %s, applying anyway. Reason: %s", outside, d.opts.emergencyChangeReason)
+		return nil
+	}
+	switch d.opts.outsideChangeWindow {
+	case outsideChangeWindowPlanOnly:
+		return &skipRemainingSteps{fmt.Sprintf("%s, skipping terraform apply.", outside)}
+	case outsideChangeWindowFail:
+		return fmt.Errorf("%s, set emergency-change and emergency-change-reason to apply anyway", outside)
+	default:
+		return fmt.Errorf("invalid outside-change-window %q, want %s or %s", d.opts.outsideChangeWindow, outsideChangeWindowFail, outsideChangeWindowPlanOnly)
+	}
+}
+
+// precheckChangeWindow checks the change windows before planning and waiting
+// for approval, so that a run which may not apply anyway fails fast instead
+// of waiting for an approver. Outside of the change windows with
+// outside-change-window set to plan-only, mode plan-apply only plans and
+// mode apply-plan skips the remaining steps. applyTerraform checks again, as
+// a change window may close while the task runs.
+func precheckChangeWindow() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if d.opts.mode == modePlan || d.opts.planOnly {
+			return d, nil
+		}
+		err := d.checkChangeWindow(d.now())
+		if skip, ok := err.(*skipRemainingSteps); ok && d.opts.mode == modePlanApply {
+			d.logger.Infof("%s", skip.msg)
+			d.opts.planOnly = true
+			return d, nil
+		}
+		return d, err
+	}
+}
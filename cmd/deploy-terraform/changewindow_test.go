@@ -0,0 +1,306 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestChangeWindowContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	office := odsChangeWindow{Days: []string{"Mon-Thu"}, Start: "09:00", End: "16:00", TimeZone: "Europe/Berlin"}
+	overnight := odsChangeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00", TimeZone: "UTC"}
+	tests := map[string]struct {
+		window odsChangeWindow
+		time   time.Time
+		want   bool
+	}{
+		"within": {
+			window: office,
+			time:   time.Date(2024, 3, 4, 9, 0, 0, 0, berlin), // Monday
+			want:   true,
+		},
+		"within in other time zone": {
+			window: office,
+			time:   time.Date(2024, 3, 7, 14, 59, 0, 0, time.UTC), // Thursday, 15:59 in Berlin
+			want:   true,
+		},
+		"at end": {
+			window: office,
+			time:   time.Date(2024, 3, 7, 16, 0, 0, 0, berlin),
+			want:   false,
+		},
+		"other day": {
+			window: office,
+			time:   time.Date(2024, 3, 8, 10, 0, 0, 0, berlin), // Friday
+			want:   false,
+		},
+		"overnight on start day": {
+			window: overnight,
+			time:   time.Date(2024, 3, 8, 23, 0, 0, 0, time.UTC), // Friday
+			want:   true,
+		},
+		"overnight on next day": {
+			window: overnight,
+			time:   time.Date(2024, 3, 9, 1, 59, 0, 0, time.UTC), // Saturday
+			want:   true,
+		},
+		"overnight before start": {
+			window: overnight,
+			time:   time.Date(2024, 3, 8, 1, 0, 0, 0, time.UTC), // Friday
+			want:   false,
+		},
+		"every day until midnight": {
+			window: odsChangeWindow{Start: "20:00", End: "24:00"},
+			time:   time.Date(2024, 3, 10, 23, 59, 0, 0, time.UTC),
+			want:   true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w, err := parseChangeWindow(tc.window)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if got := w.contains(tc.time); got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseChangeWindowsInvalid(t *testing.T) {
+	tests := map[string]struct {
+		window  odsChangeWindow
+		wantErr string
+	}{
+		"weekday": {
+			window:  odsChangeWindow{Days: []string{"Mon-Fry"}, Start: "09:00", End: "16:00"},
+			wantErr: `change window 1: invalid weekday "Fry"`,
+		},
+		"time of day": {
+			window:  odsChangeWindow{Start: "9", End: "16:00"},
+			wantErr: `change window 1: start: invalid time of day "9", want HH:MM`,
+		},
+		"empty": {
+			window:  odsChangeWindow{Start: "09:00", End: "09:00"},
+			wantErr: "change window 1: start and end are both 09:00",
+		},
+		"time zone": {
+			window:  odsChangeWindow{Start: "09:00", End: "16:00", TimeZone: "Europe/Bern"},
+			wantErr: "change window 1: time zone: unknown time zone Europe/Bern",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseChangeWindows([]odsChangeWindow{tc.window})
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckChangeWindow(t *testing.T) {
+	windows, err := parseChangeWindows([]odsChangeWindow{{Days: []string{"Mon-Fri"}, Start: "09:00", End: "16:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	within := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	outside := time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC) // Saturday
+	outsideMsg := "2024-03-09T10:00:00Z is outside of the change windows of target environment foo-prod (Mon-Fri 09:00-16:00 UTC)"
+	tests := map[string]struct {
+		opts     options
+		windows  []changeWindow
+		now      time.Time
+		wantErr  string
+		wantSkip bool
+	}{
+		"no windows": {
+			opts: options{outsideChangeWindow: outsideChangeWindowFail},
+			now:  outside,
+		},
+		"within": {
+			opts:    options{outsideChangeWindow: outsideChangeWindowFail},
+			windows: windows,
+			now:     within,
+		},
+		"outside": {
+			opts:    options{outsideChangeWindow: outsideChangeWindowFail},
+			windows: windows,
+			now:     outside,
+			wantErr: outsideMsg + ", set emergency-change and emergency-change-reason to apply anyway",
+		},
+		"outside plan only": {
+			opts:     options{outsideChangeWindow: outsideChangeWindowPlanOnly},
+			windows:  windows,
+			now:      outside,
+			wantErr:  outsideMsg + ", skipping terraform apply.",
+			wantSkip: true,
+		},
+		"outside emergency": {
+			opts:    options{outsideChangeWindow: outsideChangeWindowFail, emergencyChange: true, emergencyChangeReason: "INC-42 outage"},
+			windows: windows,
+			now:     outside,
+		},
+		"emergency without reason": {
+			opts:    options{outsideChangeWindow: outsideChangeWindowFail, emergencyChange: true},
+			windows: windows,
+			now:     outside,
+			wantErr: "emergency-change requires emergency-change-reason",
+		},
+		"invalid outside change window": {
+			opts:    options{outsideChangeWindow: "wait"},
+			windows: windows,
+			now:     outside,
+			wantErr: `invalid outside-change-window "wait", want fail or plan-only`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := tc.opts
+			opts.targetEnvironment = "foo-prod"
+			d := deployTerraformFromOptions(&opts, io.Discard, io.Discard)
+			d.changeWindows = tc.windows
+			err := d.checkChangeWindow(tc.now)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("want no err, got %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+			if _, skip := err.(*skipRemainingSteps); skip != tc.wantSkip {
+				t.Fatalf("want skip %v, got %v", tc.wantSkip, skip)
+			}
+		})
+	}
+}
+
+func TestChangeWindowList(t *testing.T) {
+	var windows changeWindowList
+	err := windows.Set("Mon-Thu,Sat 09:00-16:00 Europe/Berlin\n\n22:00-02:00")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := "Mon-Thu,Sat 09:00-16:00 Europe/Berlin\nevery day 22:00-02:00 UTC"
+	if got := windows.String(); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	tests := map[string]string{
+		"Mon-Fri":                        `change window "Mon-Fri": want [<days>] <start>-<end> [<time zone>]`,
+		"Mon-Fri 09:00 16:00":            `change window "Mon-Fri 09:00 16:00": invalid times "09:00", want <start>-<end>`,
+		"Mon 09:00-16:00 UTC extra":      `change window "Mon 09:00-16:00 UTC extra": want [<days>] <start>-<end> [<time zone>]`,
+		"Someday 09:00-16:00":            `change window "Someday 09:00-16:00": invalid weekday "Someday"`,
+		"Mon 09:00-16:00 Europe/Nowhere": `change window "Mon 09:00-16:00 Europe/Nowhere": time zone: unknown time zone Europe/Nowhere`,
+	}
+	for value, wantErr := range tests {
+		var l changeWindowList
+		if err := l.Set(value); err == nil || err.Error() != wantErr {
+			t.Fatalf("%s: want err: %s, got: %v", value, wantErr, err)
+		}
+	}
+}
+
+func TestCheckChangeWindowFlagAndODSConfig(t *testing.T) {
+	var flagWindows changeWindowList
+	if err := flagWindows.Set("Mon-Fri 09:00-16:00"); err != nil {
+		t.Fatal(err)
+	}
+	odsWindows, err := parseChangeWindows([]odsChangeWindow{{Days: []string{"Sat-Sun"}, Start: "00:00", End: "24:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saturday := time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC)
+	opts := options{targetEnvironment: "foo-prod", outsideChangeWindow: outsideChangeWindowFail, changeWindows: flagWindows}
+	d := deployTerraformFromOptions(&opts, io.Discard, io.Discard)
+	// Change windows of ods.yaml cannot open a window closed by the flag.
+	d.changeWindows = odsWindows
+	err = d.checkChangeWindow(saturday)
+	wantErr := "2024-03-09T10:00:00Z is outside of the change windows of target environment foo-prod (Mon-Fri 09:00-16:00 UTC), " +
+		"set emergency-change and emergency-change-reason to apply anyway"
+	if err == nil || err.Error() != wantErr {
+		t.Fatalf("want err: %s, got: %v", wantErr, err)
+	}
+	monday := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	err = d.checkChangeWindow(monday)
+	wantErr = "2024-03-04T10:00:00Z is outside of the change windows of target environment foo-prod (Sat-Sun 00:00-24:00 UTC), " +
+		"set emergency-change and emergency-change-reason to apply anyway"
+	if err == nil || err.Error() != wantErr {
+		t.Fatalf("want err: %s, got: %v", wantErr, err)
+	}
+	d.changeWindows = nil
+	if err := d.checkChangeWindow(monday); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+}
+
+func TestPrecheckChangeWindow(t *testing.T) {
+	windows, err := parseChangeWindows([]odsChangeWindow{{Days: []string{"Mon-Fri"}, Start: "09:00", End: "16:00"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC) // Saturday
+	outsideMsg := "2024-03-09T10:00:00Z is outside of the change windows of target environment foo-prod (Mon-Fri 09:00-16:00 UTC)"
+	tests := map[string]struct {
+		opts         options
+		wantErr      string
+		wantSkip     bool
+		wantPlanOnly bool
+	}{
+		"plan-apply outside": {
+			opts:    options{mode: modePlanApply, outsideChangeWindow: outsideChangeWindowFail},
+			wantErr: outsideMsg + ", set emergency-change and emergency-change-reason to apply anyway",
+		},
+		"plan-apply outside plan only": {
+			opts:         options{mode: modePlanApply, outsideChangeWindow: outsideChangeWindowPlanOnly},
+			wantPlanOnly: true,
+		},
+		"apply-plan outside": {
+			opts:    options{mode: modeApplyPlan, outsideChangeWindow: outsideChangeWindowFail},
+			wantErr: outsideMsg + ", set emergency-change and emergency-change-reason to apply anyway",
+		},
+		"apply-plan outside plan only": {
+			opts:     options{mode: modeApplyPlan, outsideChangeWindow: outsideChangeWindowPlanOnly},
+			wantErr:  outsideMsg + ", skipping terraform apply.",
+			wantSkip: true,
+		},
+		"plan": {
+			opts: options{mode: modePlan, outsideChangeWindow: outsideChangeWindowFail},
+		},
+		"plan only": {
+			opts:         options{mode: modePlanApply, planOnly: true, outsideChangeWindow: outsideChangeWindowFail},
+			wantPlanOnly: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := tc.opts
+			opts.targetEnvironment = "foo-prod"
+			d := deployTerraformFromOptions(&opts, io.Discard, io.Discard)
+			d.changeWindows = windows
+			d.now = func() time.Time { return outside }
+			d, err := precheckChangeWindow()(d)
+			if d.opts.planOnly != tc.wantPlanOnly {
+				t.Fatalf("want plan only %v, got %v", tc.wantPlanOnly, d.opts.planOnly)
+			}
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("want no err, got %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+			if _, skip := err.(*skipRemainingSteps); skip != tc.wantSkip {
+				t.Fatalf("want skip %v, got %v", tc.wantSkip, skip)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	discoveryStatusConfig      = "config"
+	discoveryStatusNotFound    = "not found"
+	discoveryStatusNoTerraform = "no *.tf files"
+)
+
+// discoveredDir is a candidate terraform directory found while looking for
+// terraform configs in a repository.
+type discoveredDir struct {
+	// repo is the name of the subrepo, or empty for the repository itself.
+	repo string
+	// pattern is the terraform dir (or glob) the candidate was found by.
+	pattern string
+	// dir is the path of the candidate.
+	dir string
+	// relDir is the path of the candidate relative to repoDir.
+	relDir string
+	// status is one of the discoveryStatus* constants.
+	status string
+}
+
+// hasTerraformFiles returns whether dir contains *.tf or *.tf.json files,
+// ignoring the backend configuration generated by previous versions of this
+// task.
+func hasTerraformFiles(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || workDirExcludes[name] {
+			continue
+		}
+		if strings.HasSuffix(name, ".tf") || strings.HasSuffix(name, ".tf.json") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// discoverTerraformDirs returns the candidate terraform directories of repo
+// (the name of a subrepo, or empty) located at repoDir matching patterns, which are directories or globs (e.g. infra/*)
+// relative to repoDir. Candidates are returned in the order of patterns, and
+// in lexical order for each glob. A candidate is a config only if it
+// contains terraform files.
+func discoverTerraformDirs(repo, repoDir string, patterns []string) ([]discoveredDir, error) {
+	found := []discoveredDir{}
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(repoDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid terraform dir pattern %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			found = append(found, discoveredDir{
+				repo:    repo,
+				pattern: pattern,
+				dir:     filepath.Join(repoDir, pattern),
+				relDir:  filepath.Clean(pattern),
+				status:  discoveryStatusNotFound,
+			})
+			continue
+		}
+		for _, dir := range matches {
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+			info, err := os.Stat(dir)
+			if err != nil {
+				return nil, fmt.Errorf("inspect %s: %w", dir, err)
+			}
+			if !info.IsDir() {
+				continue
+			}
+			relDir, err := filepath.Rel(repoDir, dir)
+			if err != nil {
+				return nil, fmt.Errorf("resolve %s: %w", dir, err)
+			}
+			c := discoveredDir{repo: repo, pattern: pattern, dir: dir, relDir: relDir, status: discoveryStatusNoTerraform}
+			ok, err := hasTerraformFiles(dir)
+			if err != nil {
+				return nil, fmt.Errorf("inspect %s: %w", dir, err)
+			}
+			if ok {
+				c.status = discoveryStatusConfig
+			}
+			found = append(found, c)
+		}
+	}
+	return found, nil
+}
+
+// discoveryTable formats the candidates as a table.
+func discoveryTable(candidates []discoveredDir) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPO\tPATTERN\tDIR\tSTATUS")
+	for _, c := range candidates {
+		repo := c.repo
+		if repo == "" {
+			repo = "."
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", repo, c.pattern, c.dir, c.status)
+	}
+	_ = w.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiscoverTerraformDirs(t *testing.T) {
+	repoDir := writeFiles(t, map[string]string{
+		"infra/network/main.tf":           `resource "null_resource" "a" {}`,
+		"infra/db/main.tf.json":           `{}`,
+		"infra/docs/README.md":            "docs",
+		"infra/old/backend-kubernetes.tf": `terraform {}`,
+		"infra/state/backend-s3.tf":       `resource "aws_s3_bucket" "state" {}`,
+		"infra/main.tf":                   `resource "null_resource" "b" {}`,
+	})
+	got, err := discoverTerraformDirs("", repoDir, []string{"infra/*", "infra/network", "terraform"})
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := []discoveredDir{
+		{pattern: "infra/*", relDir: "infra/db", status: discoveryStatusConfig},
+		{pattern: "infra/*", relDir: "infra/docs", status: discoveryStatusNoTerraform},
+		{pattern: "infra/*", relDir: "infra/network", status: discoveryStatusConfig},
+		{pattern: "infra/*", relDir: "infra/old", status: discoveryStatusNoTerraform},
+		{pattern: "infra/*", relDir: "infra/state", status: discoveryStatusConfig},
+		{pattern: "terraform", relDir: "terraform", status: discoveryStatusNotFound},
+	}
+	for i := range want {
+		want[i].dir = filepath.Join(repoDir, want[i].relDir)
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(discoveredDir{})); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLocateTerraformConfigs(t *testing.T) {
+	wsDir := writeFiles(t, map[string]string{
+		"terraform/main.tf":                            `resource "null_resource" "a" {}`,
+		".ods/repos/a/terraform/main.tf":               `resource "null_resource" "a" {}`,
+		".ods/repos/b/terraform/README.md":             "no config",
+		".ods/repos/c/README.md":                       "no terraform dir",
+		".ods/repos/d/terraform/backend-kubernetes.tf": `terraform {}`,
+	})
+	chdir(t, wsDir)
+	subrepos, err := os.ReadDir(".ods/repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{terraformDir: "./terraform", targetEnvironment: "dev"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.subrepos = subrepos
+	d, err = locateTerraformConfigs()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	got := []string{}
+	for _, tfConfig := range d.tfConfigs {
+		got = append(got, tfConfig.terraformDir)
+	}
+	want := []string{"terraform", ".ods/repos/a/terraform"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	if d.tfConfigs[1].subrepo.Name() != "a" {
+		t.Fatalf("want subrepo a, got %s", d.tfConfigs[1].subrepo.Name())
+	}
+}
+
+// chdir changes the working directory to dir for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLocateMultipleTerraformConfigs(t *testing.T) {
+	wsDir := writeFiles(t, map[string]string{
+		"infra/app/main.tf":     `resource "null_resource" "a" {}`,
+		"infra/db/main.tf":      `resource "null_resource" "a" {}`,
+		"infra/network/main.tf": `resource "null_resource" "a" {}`,
+	})
+	chdir(t, wsDir)
+	opts := &options{terraformDir: "infra/network\ninfra/db\ninfra/*", targetEnvironment: "dev"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d, err := locateTerraformConfigs()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	got := []string{}
+	for _, tfConfig := range d.tfConfigs {
+		got = append(got, tfConfig.artifactName)
+	}
+	want := []string{"infra-network-plan-dev", "infra-db-plan-dev", "infra-app-plan-dev"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+const (
+	envSourceKindSecret    = "secret"
+	envSourceKindConfigMap = "configmap"
+	envSourceKindVault     = "vault"
+)
+
+// envSource is a Secret, ConfigMap or Vault KV path from which env variables
+// are derived.
+type envSource struct {
+	kind string
+	name string
+	// prefix is prepended to each key of the source.
+	prefix string
+}
+
+func (s envSource) String() string {
+	return fmt.Sprintf("%s/%s", s.kind, s.name)
+}
+
+// parseEnvSource parses an env source given as <kind>:<name>[:<prefix>],
+// where kind is one of "secret", "configmap" or "vault". For kind "vault",
+// name is the path of the secret in the KV secrets engine.
+func parseEnvSource(value string) (envSource, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return envSource{}, fmt.Errorf("env source '%s' is not of the form <kind>:<name>[:<prefix>]", value)
+	}
+	s := envSource{kind: strings.ToLower(parts[0]), name: parts[1]}
+	if len(parts) == 3 {
+		s.prefix = parts[2]
+	}
+	if s.kind != envSourceKindSecret && s.kind != envSourceKindConfigMap && s.kind != envSourceKindVault {
+		return envSource{}, fmt.Errorf("env source '%s' has unknown kind '%s', must be one of %s, %s, %s", value, parts[0], envSourceKindSecret, envSourceKindConfigMap, envSourceKindVault)
+	}
+	return s, nil
+}
+
+// envSourcesResult holds the env variables merged from all env sources.
+type envSourcesResult struct {
+	env map[string]string
+	// plainKeys are the keys of env which stem from a ConfigMap and
+	// therefore need not be masked.
+	plainKeys map[string]bool
+	// conflicts describes keys defined by more than one source.
+	conflicts []string
+}
+
+// envSourceReader returns the data of an env source.
+type envSourceReader func(s envSource) (map[string]string, error)
+
+// kubernetesEnvSourceReader returns a reader for Secrets and ConfigMaps in namespace.
+func kubernetesEnvSourceReader(clientset k8s.Interface, namespace string) envSourceReader {
+	return func(s envSource) (map[string]string, error) {
+		switch s.kind {
+		case envSourceKindSecret:
+			return kubernetes.GetSecrets(clientset, namespace, s.name)
+		case envSourceKindConfigMap:
+			return kubernetes.GetConfigMapData(clientset, namespace, s.name)
+		}
+		return nil, fmt.Errorf("unsupported env source kind %s", s.kind)
+	}
+}
+
+// loadEnvSources reads all sources and merges their data.
+// Sources listed later take precedence over earlier ones.
+func loadEnvSources(sources []envSource, read envSourceReader) (*envSourcesResult, error) {
+	result := &envSourcesResult{
+		env:       make(map[string]string),
+		plainKeys: make(map[string]bool),
+		conflicts: []string{},
+	}
+	origin := make(map[string]envSource)
+	for _, s := range sources {
+		data, err := read(s)
+		if err != nil {
+			return nil, fmt.Errorf("getting %s failed: %w", s, err)
+		}
+		keys := getKeys(data)
+		sort.Strings(keys)
+		for _, k := range keys {
+			key := s.prefix + k
+			if previous, ok := origin[key]; ok {
+				result.conflicts = append(result.conflicts, fmt.Sprintf("%s from %s overrides %s", key, s, previous))
+			}
+			origin[key] = s
+			result.env[key] = data[k]
+			if s.kind == envSourceKindConfigMap {
+				result.plainKeys[key] = true
+			} else {
+				delete(result.plainKeys, key)
+			}
+		}
+	}
+	return result, nil
+}
+
+// envFile is an env variable pointing at a file which holds the value of
+// key of the env sources.
+type envFile struct {
+	name string
+	key  string
+}
+
+// parseEnvFile parses an env file given as <name>[=<key>]. If key is
+// omitted, it equals name.
+func parseEnvFile(value string) (envFile, error) {
+	name, key, found := strings.Cut(value, "=")
+	if !found {
+		key = name
+	}
+	if !variableNamePattern.MatchString(name) || key == "" {
+		return envFile{}, fmt.Errorf("env file '%s' is not of the form <name>[=<key>]", value)
+	}
+	return envFile{name: name, key: key}, nil
+}
+
+// isFileName returns whether name is a single path element which does not
+// refer to the directory itself or its parent.
+func isFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// writeEnvFiles writes the value of each env file key into a file in dir,
+// removes the key from env and returns env variables pointing at the files.
+func writeEnvFiles(dir string, files []envFile, env map[string]string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, f := range files {
+		value, ok := env[f.key]
+		if !ok {
+			return nil, fmt.Errorf("key '%s' for env file %s is not present in any env source", f.key, f.name)
+		}
+		if !isFileName(f.key) {
+			return nil, fmt.Errorf("key '%s' for env file %s is not a valid file name", f.key, f.name)
+		}
+		path := filepath.Join(dir, f.key)
+		if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+			return nil, fmt.Errorf("write env file %s: %w", f.name, err)
+		}
+		paths[f.name] = path
+	}
+	for _, f := range files {
+		delete(env, f.key)
+	}
+	return paths, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseEnvSource(t *testing.T) {
+	tests := map[string]struct {
+		value   string
+		want    envSource
+		wantErr bool
+	}{
+		"secret": {
+			value: "secret:cloud-credentials",
+			want:  envSource{kind: "secret", name: "cloud-credentials"},
+		},
+		"configmap with prefix": {
+			value: "configmap:settings:TF_VAR_",
+			want:  envSource{kind: "configmap", name: "settings", prefix: "TF_VAR_"},
+		},
+		"kind is case insensitive": {
+			value: "ConfigMap:settings",
+			want:  envSource{kind: "configmap", name: "settings"},
+		},
+		"missing name": {
+			value:   "secret:",
+			wantErr: true,
+		},
+		"missing kind": {
+			value:   "settings",
+			wantErr: true,
+		},
+		"vault": {
+			value: "vault:foo/dev:TF_VAR_",
+			want:  envSource{kind: "vault", name: "foo/dev", prefix: "TF_VAR_"},
+		},
+		"unknown kind": {
+			value:   "aws:settings",
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseEnvSource(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(envSource{})); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadEnvSources(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "terraform-envs-dev", Namespace: "ns"},
+			Type:       corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				"ARM_CLIENT_SECRET": []byte("s3cr3t"),
+				"TF_VAR_region":     []byte("eu-west-1"),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "ns"},
+			Type:       corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				"ARM_CLIENT_SECRET": []byte("shared-s3cr3t"),
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "ns"},
+			Data: map[string]string{
+				"region": "eu-central-1",
+				"size":   "small",
+			},
+		},
+	)
+	read := kubernetesEnvSourceReader(clientset, "ns")
+	result, err := loadEnvSources([]envSource{
+		{kind: envSourceKindSecret, name: "shared"},
+		{kind: envSourceKindSecret, name: "terraform-envs-dev"},
+		{kind: envSourceKindConfigMap, name: "settings", prefix: "TF_VAR_"},
+	}, read)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	wantEnv := map[string]string{
+		"ARM_CLIENT_SECRET": "s3cr3t",
+		"TF_VAR_region":     "eu-central-1",
+		"TF_VAR_size":       "small",
+	}
+	if diff := cmp.Diff(wantEnv, result.env); diff != "" {
+		t.Fatalf("env mismatch (-want +got):\n%s", diff)
+	}
+	wantPlainKeys := map[string]bool{
+		"TF_VAR_region": true,
+		"TF_VAR_size":   true,
+	}
+	if diff := cmp.Diff(wantPlainKeys, result.plainKeys); diff != "" {
+		t.Fatalf("plain keys mismatch (-want +got):\n%s", diff)
+	}
+	wantConflicts := []string{
+		"ARM_CLIENT_SECRET from secret/terraform-envs-dev overrides secret/shared",
+		"TF_VAR_region from configmap/settings overrides secret/terraform-envs-dev",
+	}
+	if diff := cmp.Diff(wantConflicts, result.conflicts); diff != "" {
+		t.Fatalf("conflicts mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = loadEnvSources([]envSource{{kind: envSourceKindConfigMap, name: "missing"}}, read)
+	if err == nil {
+		t.Fatal("want err for missing source, got none")
+	}
+}
+
+func TestWriteEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []envFile{}
+	for _, v := range []string{"GOOGLE_APPLICATION_CREDENTIALS=GCP_CREDENTIALS_JSON", "ARM_CLIENT_CERTIFICATE_PATH=TLS_CRT"} {
+		f, err := parseEnvFile(v)
+		if err != nil {
+			t.Fatalf("want no err, got %s", err)
+		}
+		files = append(files, f)
+	}
+	env := map[string]string{
+		"GCP_CREDENTIALS_JSON": `{"type": "external_account"}`,
+		"TLS_CRT":              "-----BEGIN CERTIFICATE-----",
+		"ARM_CLIENT_ID":        "id",
+	}
+	paths, err := writeEnvFiles(dir, files, env)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	wantPaths := map[string]string{
+		"GOOGLE_APPLICATION_CREDENTIALS": filepath.Join(dir, "GCP_CREDENTIALS_JSON"),
+		"ARM_CLIENT_CERTIFICATE_PATH":    filepath.Join(dir, "TLS_CRT"),
+	}
+	if diff := cmp.Diff(wantPaths, paths); diff != "" {
+		t.Fatalf("paths mismatch (-want +got):\n%s", diff)
+	}
+	content, err := os.ReadFile(paths["GOOGLE_APPLICATION_CREDENTIALS"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != `{"type": "external_account"}` {
+		t.Fatalf("unexpected file content: %s", content)
+	}
+	if diff := cmp.Diff(map[string]string{"ARM_CLIENT_ID": "id"}, env); diff != "" {
+		t.Fatalf("env mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = writeEnvFiles(dir, []envFile{{name: "FOO", key: "MISSING"}}, env)
+	if err == nil {
+		t.Fatal("want err for missing key, got none")
+	}
+
+	for _, key := range []string{"../FOO", "sub/FOO", "..", "."} {
+		_, err = writeEnvFiles(dir, []envFile{{name: "FOO", key: key}}, map[string]string{key: "value"})
+		if err == nil || err.Error() != "key '"+key+"' for env file FOO is not a valid file name" {
+			t.Fatalf("want err for key %s, got %v", key, err)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	f, err := parseEnvFile("GOOGLE_APPLICATION_CREDENTIALS")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := envFile{name: "GOOGLE_APPLICATION_CREDENTIALS", key: "GOOGLE_APPLICATION_CREDENTIALS"}
+	if diff := cmp.Diff(want, f, cmp.AllowUnexported(envFile{})); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := parseEnvFile("1FOO=BAR"); err == nil {
+		t.Fatal("want err for invalid name, got none")
+	}
+	if _, err := parseEnvFile("FOO="); err == nil {
+		t.Fatal("want err for empty key, got none")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-terraform/internal/identity"
+)
+
+const (
+	workloadIdentityAWS   = "aws"
+	workloadIdentityAzure = "azure"
+	workloadIdentityGCP   = "gcp"
+
+	// maxAWSSessionNameLength is the maximum length of RoleSessionName.
+	maxAWSSessionNameLength = 64
+)
+
+// invalidSessionNameChars matches characters not allowed in an AWS RoleSessionName.
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// plainWorkloadIdentityEnvKeys are env variables set by a workload identity
+// exchange which are not secret and therefore not masked.
+var plainWorkloadIdentityEnvKeys = map[string]bool{
+	"ARM_USE_OIDC":  true,
+	"ARM_TENANT_ID": true,
+	"ARM_CLIENT_ID": true,
+}
+
+// workloadIdentity describes how to exchange the service account token for
+// short-lived cloud credentials.
+type workloadIdentity struct {
+	// provider is one of aws, azure or gcp.
+	provider string
+	// args are the provider specific arguments:
+	// aws: role ARN; azure: tenant ID, client ID;
+	// gcp: workload identity pool provider, optional service account.
+	args []string
+}
+
+func (w workloadIdentity) String() string {
+	return fmt.Sprintf("%s:%s", w.provider, strings.Join(w.args, ":"))
+}
+
+// parseWorkloadIdentity parses a workload identity given as
+// <provider>:<arg>[:<arg>].
+func parseWorkloadIdentity(value string) (workloadIdentity, error) {
+	parts := strings.SplitN(value, ":", 3)
+	w := workloadIdentity{provider: strings.ToLower(parts[0]), args: parts[1:]}
+	var minArgs, maxArgs int
+	switch w.provider {
+	case workloadIdentityAWS:
+		// Role ARNs contain colons themselves.
+		w.args = []string{strings.TrimPrefix(value, parts[0]+":")}
+		minArgs, maxArgs = 1, 1
+	case workloadIdentityAzure:
+		minArgs, maxArgs = 2, 2
+	case workloadIdentityGCP:
+		minArgs, maxArgs = 1, 2
+	default:
+		return workloadIdentity{}, fmt.Errorf("workload identity '%s' has unknown provider '%s', must be one of %s, %s, %s", value, parts[0], workloadIdentityAWS, workloadIdentityAzure, workloadIdentityGCP)
+	}
+	if len(parts) < 2 || len(w.args) < minArgs || len(w.args) > maxArgs {
+		return workloadIdentity{}, fmt.Errorf("workload identity '%s' has wrong number of arguments for provider %s", value, w.provider)
+	}
+	for _, a := range w.args[:minArgs] {
+		if a == "" {
+			return workloadIdentity{}, fmt.Errorf("workload identity '%s' has empty arguments", value)
+		}
+	}
+	return w, nil
+}
+
+// selectWorkloadIdentity returns the workload identity configured for env.
+// Specs are given as [<env>=]<provider>:<arg>[:<arg>]. A spec for env takes
+// precedence over a spec without environment. nil is returned if no spec
+// applies.
+func selectWorkloadIdentity(specs []string, env string) (*workloadIdentity, error) {
+	var general, specific *workloadIdentity
+	for _, spec := range specs {
+		specEnv, value, found := strings.Cut(spec, "=")
+		if !found {
+			specEnv, value = "", spec
+		}
+		w, err := parseWorkloadIdentity(value)
+		if err != nil {
+			return nil, err
+		}
+		switch specEnv {
+		case "":
+			general = &w
+		case env:
+			specific = &w
+		}
+	}
+	if specific != nil {
+		return specific, nil
+	}
+	return general, nil
+}
+
+// exchangeWorkloadIdentity exchanges the token in tokenFile for the
+// credentials described by w.
+func (d *deployTerraform) exchangeWorkloadIdentity(w *workloadIdentity, tokenFile string) (map[string]string, error) {
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if d.identityExchanger == nil {
+		d.identityExchanger = identity.NewExchanger()
+	}
+	switch w.provider {
+	case workloadIdentityAWS:
+		return d.identityExchanger.AWS(token, w.args[0], d.awsSessionName())
+	case workloadIdentityAzure:
+		return identity.Azure(token, w.args[0], w.args[1]), nil
+	case workloadIdentityGCP:
+		serviceAccount := ""
+		if len(w.args) > 1 {
+			serviceAccount = w.args[1]
+		}
+		return d.identityExchanger.GCP(token, w.args[0], serviceAccount)
+	}
+	return nil, fmt.Errorf("unsupported workload identity provider %s", w.provider)
+}
+
+// awsSessionName returns a RoleSessionName identifying the component and
+// target environment.
+func (d *deployTerraform) awsSessionName() string {
+	name := invalidSessionNameChars.ReplaceAllString(fmt.Sprintf("ods-%s-%s", d.ctxt.Component, d.opts.targetEnvironment), "-")
+	if len(name) > maxAWSSessionNameLength {
+		name = name[:maxAWSSessionNameLength]
+	}
+	return name
+}
+
+// refreshWorkloadIdentity exchanges the service account token again after
+// waiting for approval, as the credentials obtained during setup are
+// short-lived (usually one hour) and may have expired while waiting. The
+// token file is rotated by the kubelet, so it holds a valid token again.
+func refreshWorkloadIdentity() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if !d.opts.requireApproval {
+			return d, nil
+		}
+		w, err := selectWorkloadIdentity(d.opts.workloadIdentities, d.opts.targetEnvironment)
+		if err != nil {
+			return d, err
+		}
+		if w == nil {
+			return d, nil
+		}
+		d.logger.Infof("exchanging service account token again for credentials of %s", w)
+		env, err := d.exchangeWorkloadIdentity(w, d.opts.workloadIdentityTokenFile)
+		if err != nil {
+			return d, fmt.Errorf("workload identity %s: %w", w, err)
+		}
+		for k, v := range env {
+			d.secretEnvVars[k] = v
+		}
+		return d, nil
+	}
+}
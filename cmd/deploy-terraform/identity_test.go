@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline-terraform/internal/identity"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+func TestSelectWorkloadIdentity(t *testing.T) {
+	specs := []string{
+		"gcp://iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/ods",
+		"foo-prod=aws:arn:aws:iam::123456789012:role/terraform",
+		"foo-qa=azure:tenant:client",
+	}
+	tests := map[string]struct {
+		specs   []string
+		env     string
+		want    *workloadIdentity
+		wantErr bool
+	}{
+		"general": {
+			specs: specs,
+			env:   "foo-dev",
+			want:  &workloadIdentity{provider: "gcp", args: []string{"//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/ods"}},
+		},
+		"aws role ARN with colons": {
+			specs: specs,
+			env:   "foo-prod",
+			want:  &workloadIdentity{provider: "aws", args: []string{"arn:aws:iam::123456789012:role/terraform"}},
+		},
+		"azure": {
+			specs: specs,
+			env:   "foo-qa",
+			want:  &workloadIdentity{provider: "azure", args: []string{"tenant", "client"}},
+		},
+		"gcp with service account": {
+			specs: []string{"gcp://iam.googleapis.com/pool:terraform@proj.iam.gserviceaccount.com"},
+			env:   "dev",
+			want:  &workloadIdentity{provider: "gcp", args: []string{"//iam.googleapis.com/pool", "terraform@proj.iam.gserviceaccount.com"}},
+		},
+		"none": {
+			specs: []string{"foo-prod=aws:arn:aws:iam::123456789012:role/terraform"},
+			env:   "foo-dev",
+		},
+		"unknown provider": {
+			specs:   []string{"ibm:foo"},
+			wantErr: true,
+		},
+		"azure without client": {
+			specs:   []string{"azure:tenant"},
+			wantErr: true,
+		},
+		"aws without role": {
+			specs:   []string{"aws:"},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := selectWorkloadIdentity(tc.specs, tc.env)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want err, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(workloadIdentity{})); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetupWorkloadIdentity(t *testing.T) {
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Form.Get("WebIdentityToken") != "sa-jwt" || r.Form.Get("RoleSessionName") != "ods-foo-foo-dev" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &options{
+		targetEnvironment:         "foo-dev",
+		workloadIdentities:        []string{"aws:arn:aws:iam::123456789012:role/terraform"},
+		workloadIdentityTokenFile: tokenFile,
+	}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Component: "foo"}
+	d.identityExchanger = identity.NewExchanger()
+	d.identityExchanger.AWSSTSEndpoint = sts.URL
+	d.secretEnvVars = map[string]string{"TF_VAR_hello": "world"}
+
+	d, err := setupWorkloadIdentity()(d)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := map[string]string{
+		"TF_VAR_hello":          "world",
+		"AWS_ACCESS_KEY_ID":     "ASIAEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "session",
+	}
+	if diff := cmp.Diff(want, d.secretEnvVars); diff != "" {
+		t.Fatalf("env mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRefreshWorkloadIdentity(t *testing.T) {
+	requests := 0
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIAFRESH</AccessKeyId><SecretAccessKey>fresh</SecretAccessKey><SessionToken>fresh-session</SessionToken>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expired := map[string]string{
+		"TF_VAR_hello":          "world",
+		"AWS_ACCESS_KEY_ID":     "ASIAEXPIRED",
+		"AWS_SECRET_ACCESS_KEY": "expired",
+		"AWS_SESSION_TOKEN":     "expired-session",
+	}
+	tests := map[string]struct {
+		requireApproval bool
+		want            map[string]string
+		wantRequests    int
+	}{
+		"without approval": {
+			want: expired,
+		},
+		"after approval": {
+			requireApproval: true,
+			want: map[string]string{
+				"TF_VAR_hello":          "world",
+				"AWS_ACCESS_KEY_ID":     "ASIAFRESH",
+				"AWS_SECRET_ACCESS_KEY": "fresh",
+				"AWS_SESSION_TOKEN":     "fresh-session",
+			},
+			wantRequests: 1,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			requests = 0
+			opts := &options{
+				targetEnvironment:         "foo-dev",
+				workloadIdentities:        []string{"aws:arn:aws:iam::123456789012:role/terraform"},
+				workloadIdentityTokenFile: tokenFile,
+				requireApproval:           tc.requireApproval,
+			}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Component: "foo"}
+			d.identityExchanger = identity.NewExchanger()
+			d.identityExchanger.AWSSTSEndpoint = sts.URL
+			d.secretEnvVars = map[string]string{}
+			for k, v := range expired {
+				d.secretEnvVars[k] = v
+			}
+			d, err := refreshWorkloadIdentity()(d)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.want, d.secretEnvVars); diff != "" {
+				t.Fatalf("env mismatch (-want +got):\n%s", diff)
+			}
+			if requests != tc.wantRequests {
+				t.Fatalf("want %d requests, got %d", tc.wantRequests, requests)
+			}
+		})
+	}
+}
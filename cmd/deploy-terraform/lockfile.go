@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+)
+
+// providerLock is the version and the hashes of a provider recorded in the
+// dependency lock file (.terraform.lock.hcl).
+type providerLock struct {
+	Version string   `json:"version"`
+	Hashes  []string `json:"hashes"`
+}
+
+// lockFile is the part of a dependency lock file of interest here.
+type lockFile struct {
+	Providers []struct {
+		Source  string   `hcl:"source,label"`
+		Version string   `hcl:"version,optional"`
+		Hashes  []string `hcl:"hashes,optional"`
+		Remain  hcl.Body `hcl:",remain"`
+	} `hcl:"provider,block"`
+	Remain hcl.Body `hcl:",remain"`
+}
+
+// parseLockFile returns the providers recorded in the content of a
+// dependency lock file by their source address.
+func parseLockFile(content string) (map[string]providerLock, error) {
+	f, err := parseHCLFile(hclparse.NewParser(), ".terraform.lock.hcl", []byte(content))
+	if err != nil {
+		return nil, err
+	}
+	var lf lockFile
+	if diags := gohcl.DecodeBody(f.Body, nil, &lf); diags.HasErrors() {
+		return nil, fmt.Errorf("decode .terraform.lock.hcl: %w", diags)
+	}
+	providers := map[string]providerLock{}
+	for _, p := range lf.Providers {
+		hashes := p.Hashes
+		if hashes == nil {
+			hashes = []string{}
+		}
+		providers[p.Source] = providerLock{Version: p.Version, Hashes: hashes}
+	}
+	return providers, nil
+}
+
+// providerLockMismatches compares the providers recorded at plan time with
+// the ones installed now. Hashes may be added (e.g. for another platform)
+// but not removed.
+func providerLockMismatches(planned, installed map[string]providerLock) []string {
+	mismatches := []string{}
+	for source, p := range planned {
+		i, ok := installed[source]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("provider %s is no longer installed", source))
+			continue
+		}
+		if i.Version != p.Version {
+			mismatches = append(mismatches, fmt.Sprintf("provider %s has version %s instead of %s", source, i.Version, p.Version))
+			continue
+		}
+		hashes := map[string]bool{}
+		for _, h := range i.Hashes {
+			hashes[h] = true
+		}
+		for _, h := range p.Hashes {
+			if !hashes[h] {
+				mismatches = append(mismatches, fmt.Sprintf("provider %s no longer matches hash %s", source, h))
+				break
+			}
+		}
+	}
+	for source := range installed {
+		if _, ok := planned[source]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("provider %s was not installed at plan time", source))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches
+}
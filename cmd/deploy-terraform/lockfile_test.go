@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseLockFile(t *testing.T) {
+	content := `# This file is maintained automatically by "terraform init".
+# Manual edits may be lost in future updates.
+
+provider "registry.terraform.io/hashicorp/aws" {
+  version     = "5.31.0"
+  constraints = "~> 5.0"
+  hashes = [
+    "h1:abc=",
+    "zh:0123",
+  ]
+}
+
+provider "registry.terraform.io/hashicorp/null" {
+  version = "3.2.2"
+  hashes  = ["h1:def="]
+}
+`
+	want := map[string]providerLock{
+		"registry.terraform.io/hashicorp/aws":  {Version: "5.31.0", Hashes: []string{"h1:abc=", "zh:0123"}},
+		"registry.terraform.io/hashicorp/null": {Version: "3.2.2", Hashes: []string{"h1:def="}},
+	}
+	got, err := parseLockFile(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("providers mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProviderLockMismatches(t *testing.T) {
+	aws := "registry.terraform.io/hashicorp/aws"
+	null := "registry.terraform.io/hashicorp/null"
+	planned := map[string]providerLock{aws: {Version: "5.31.0", Hashes: []string{"h1:abc="}}}
+	tests := map[string]struct {
+		installed map[string]providerLock
+		want      []string
+	}{
+		"same": {
+			installed: planned,
+			want:      []string{},
+		},
+		"hash added": {
+			installed: map[string]providerLock{aws: {Version: "5.31.0", Hashes: []string{"h1:abc=", "h1:xyz="}}},
+			want:      []string{},
+		},
+		"hash changed": {
+			installed: map[string]providerLock{aws: {Version: "5.31.0", Hashes: []string{"h1:xyz="}}},
+			want:      []string{"provider " + aws + " no longer matches hash h1:abc="},
+		},
+		"version changed": {
+			installed: map[string]providerLock{aws: {Version: "5.32.0", Hashes: []string{"h1:xyz="}}},
+			want:      []string{"provider " + aws + " has version 5.32.0 instead of 5.31.0"},
+		},
+		"provider replaced": {
+			installed: map[string]providerLock{null: {Version: "3.2.2"}},
+			want: []string{
+				"provider " + aws + " is no longer installed",
+				"provider " + null + " was not installed at plan time",
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := providerLockMismatches(planned, tc.installed)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -6,7 +6,12 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/opendevstack/ods-pipeline-terraform/internal/identity"
+	"github.com/opendevstack/ods-pipeline-terraform/internal/vault"
 	"github.com/opendevstack/ods-pipeline/pkg/logging"
 	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
 	"k8s.io/client-go/kubernetes"
@@ -17,25 +22,132 @@ const (
 	kubernetesServiceaccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
 )
 
+// Modes of operation.
+const (
+	// modePlanApply plans and applies in the same task run.
+	modePlanApply = "plan-apply"
+	// modePlan plans and saves plan bundles.
+	modePlan = "plan"
+	// modeApplyPlan applies the plan bundles saved by an earlier task run.
+	modeApplyPlan = "apply-plan"
+)
+
 type options struct {
 	// Location of checkout directory.
 	checkoutDir string
-	// Location of terraform files directory.
+	// Location of the kubeconfig file to use instead of the in-cluster config.
+	kubeconfig string
+	// Context of the kubeconfig to use instead of the in-cluster config.
+	kubeContext string
+	// Namespace in which the state is stored. Defaults to the pipeline namespace.
+	stateNamespace string
+	// Namespace from which Secrets and ConfigMaps are read. Defaults to the
+	// pipeline namespace.
+	secretsNamespace string
+	// Naming template of the state secret suffix (text/template with fields
+	// Project, Repository, Component, Subrepo, Environment and TerraformDir).
+	stateSecretSuffix string
+	// Naming template of the state secret suffix of terraform configs in
+	// subrepos.
+	subrepoStateSecretSuffix string
+	// Labels (key=value) added to the state secrets.
+	stateLabels stringList
+	// Naming template of a previous state secret suffix to move existing
+	// state from.
+	migrateStateFrom string
+	// Backend to store the state in (kubernetes or s3).
+	backend string
+	// S3 bucket to store the state in if backend is s3.
+	s3Bucket string
+	// Prefix of the state object key in the S3 bucket.
+	s3KeyPrefix string
+	// Region of the S3 bucket.
+	s3Region string
+	// DynamoDB table used for state locking with the s3 backend.
+	s3DynamoDBTable string
+	// Comma-separated percentages of the Kubernetes secret size limit at
+	// which to warn about the size of the state secret.
+	stateSizeWarnThresholds stateSizeThresholds
+	// File to write the size of the state secret to.
+	stateSizeResult string
+	// Location of terraform files directories (or globs), one per line.
 	terraformDir string
 	// Terraform Kubernetes Backend secret_suffix will be incorporated here..
 	targetEnvironment string
+	// Stage (dev, qa or prod) of the target environment, used to resolve
+	// stage-level .tfvars files. Derived from targetEnvironment if empty.
+	stage string
+	// Terraform workspace to select (and create if missing) after init.
+	// Empty means the "default" workspace.
+	workspace string
+	// Identifier of the build (e.g. the TaskRun name), exposed as ods_build.
+	build string
 	// Whether to derive env variables from the k8s secret
 	envFromSecret bool
+	// Additional Secrets and ConfigMaps (<kind>:<name>[:<prefix>]) to derive
+	// env variables from. Later sources take precedence.
+	envSources stringList
+	// Keys of the env sources to write into files, given as <name>[=<key>].
+	// Env variable name is set to the path of the file.
+	envFiles stringList
+	// Whether to fail if a key is defined by more than one env source.
+	failOnEnvConflict bool
+	// Address of the Vault server used for env sources of kind vault.
+	vaultAddr string
+	// Vault role to login with using the Kubernetes auth method.
+	vaultRole string
+	// Path at which the Kubernetes auth method is mounted in Vault.
+	vaultAuthPath string
+	// Mount path of the KV version 2 secrets engine in Vault.
+	vaultKVMount string
+	// Workload identities to exchange the service account token for cloud
+	// credentials, given as [<env>=]<provider>:<arg>[:<arg>].
+	workloadIdentities stringList
+	// File containing the service account token used for workload identity.
+	workloadIdentityTokenFile string
+	// Mode of operation: plan-apply, plan or apply-plan.
+	mode string
 	// Whether to apply or plan only without changing existing resources.
 	planOnly bool
+	// Git refs (names or patterns) from which changes are applied. If set,
+	// pipeline runs for other refs and for pull requests only plan.
+	applyRefs stringList
+	// Additional .tfvars files, relative to the terraform directory.
+	varFiles stringList
+	// Additional input variables as name=value pairs.
+	vars stringList
 	// terraform apply extra args
 	applyExtraArgs string
 	// terraform plan extra args
 	planExtraArgs string
+	// Duration to retry acquiring the state lock, passed as -lock-timeout.
+	lockTimeout string
+	// Number of concurrent operations of terraform plan and apply. 0 means
+	// the terraform default.
+	parallelism int
+	// Whether to fail instead of applying a plan which destroys resources.
+	preventDestroy bool
+	// Whether to wait for manual approval of the plan before applying it.
+	requireApproval bool
+	// Duration to wait for approval before failing.
+	approvalTimeout string
+	// Change windows of the target environment. Change windows of ods.yaml
+	// can only restrict them further.
+	changeWindows changeWindowList
+	// What to do when applying outside of the change windows of the target
+	// environment: fail or plan-only.
+	outsideChangeWindow string
+	// Whether to apply outside of the change windows.
+	emergencyChange bool
+	// Reason of the emergency change, required with emergencyChange.
+	emergencyChangeReason string
 	// Whether to enable debug mode.
 	debug bool
 	// Whether to enable verbose mode.
 	verbose bool
+	// Names of the flags given with a non-empty value. These take precedence
+	// over ods.yaml.
+	explicitFlags map[string]bool
 }
 
 type terraformConfig struct {
@@ -44,8 +156,31 @@ type terraformConfig struct {
 	subrepoArtifacts []string
 	// directory where terraform config (*.tf) files are located at.
 	terraformDir string
+	// terraformDir relative to the root of its repository (or subrepo).
+	relDir string
+	// scratch copy of terraformDir in which terraform runs.
+	workDir string
+	// suffix of the state secret (or key of the state object) of this config.
+	secretSuffix string
+	// suffix to move the state secrets to once changes are applied, if state
+	// is migrated from secretSuffix (see migrate-state-from).
+	migrateToSuffix string
 	// artifact name
 	artifactName string
+	// whether terraform plan detected changes.
+	hasChanges bool
+	// number of resources terraform plan destroys (including replacements).
+	destroyCount int
+	// summary line of terraform plan.
+	planSummary string
+	// manifest of the plan bundle restored in mode apply-plan.
+	planManifest *planBundleManifest
+	// whether the plan is saved in the work dir, to be applied as is.
+	savedPlan bool
+	// .tfvars files passed via -var-file, in order of increasing precedence.
+	varFiles []string
+	// TF_VAR_ods_* env variables for ODS context variables declared by the config.
+	contextVarsEnv map[string]string
 }
 
 func (t terraformConfig) String() string {
@@ -69,28 +204,101 @@ type deployTerraform struct {
 	terraformBin        string
 	opts                *options
 	ctxt                *pipelinectxt.ODSContext
-	clientset           *kubernetes.Clientset
-	secretName          string
+	clientset           kubernetes.Interface
+	kubeconfigPath      string
+	kubeContext         string
+	stateLabels         map[string]string
+	odsConfig           *odsTerraformConfig
 	secretEnvVars       map[string]string
+	plainEnvKeys        map[string]bool
+	vaultClient         *vault.Client
+	identityExchanger   *identity.Exchanger
+	inputVars           []inputVar
 	pluginCacheDir      string
-	varFiles            []string
 	subrepos            []fs.DirEntry
 	deploymentArtifacts []string
 	tfConfigs           []terraformConfig
-	outWriter           io.Writer
-	errWriter           io.Writer
+	// Key with which plan bundles are encrypted, read on first use.
+	planBundleKey []byte
+	outWriter     io.Writer
+	errWriter     io.Writer
+	cleanupFuncs  []func()
+	// Interval in which the approval ConfigMap is checked.
+	approvalPollInterval time.Duration
+	// Change windows of the target environment from ods.yaml, applying in
+	// addition to the ones of the options. Empty means no restriction.
+	changeWindows []changeWindow
+	// now returns the current time, used to check the change windows.
+	now func() time.Time
 }
 
 var defaultOptions = options{
-	checkoutDir:       ".",
-	terraformDir:      "./terraform",
-	targetEnvironment: "dev",
-	envFromSecret:     true,
-	planOnly:          false,
-	applyExtraArgs:    "",
-	planExtraArgs:     "",
-	debug:             (os.Getenv("DEBUG") == "true"),
-	verbose:           false,
+	checkoutDir:               ".",
+	kubeconfig:                "",
+	kubeContext:               "",
+	stateNamespace:            "",
+	secretsNamespace:          "",
+	stateSecretSuffix:         defaultStateSecretSuffix,
+	subrepoStateSecretSuffix:  defaultSubrepoStateSecretSuffix,
+	migrateStateFrom:          "",
+	backend:                   backendKubernetes,
+	s3Bucket:                  "",
+	s3KeyPrefix:               "",
+	s3Region:                  os.Getenv("AWS_REGION"),
+	s3DynamoDBTable:           "",
+	stateSizeWarnThresholds:   stateSizeThresholds{75, 90},
+	stateSizeResult:           "",
+	terraformDir:              "./terraform",
+	targetEnvironment:         "dev",
+	stage:                     "",
+	workspace:                 "",
+	build:                     "",
+	envFromSecret:             true,
+	failOnEnvConflict:         false,
+	vaultAddr:                 os.Getenv("VAULT_ADDR"),
+	vaultRole:                 "",
+	vaultAuthPath:             "kubernetes",
+	vaultKVMount:              "secret",
+	workloadIdentityTokenFile: tokenFile,
+	mode:                      modePlanApply,
+	planOnly:                  false,
+	applyExtraArgs:            "",
+	planExtraArgs:             "",
+	lockTimeout:               "",
+	parallelism:               0,
+	preventDestroy:            false,
+	requireApproval:           false,
+	approvalTimeout:           "1h",
+	outsideChangeWindow:       outsideChangeWindowFail,
+	emergencyChange:           false,
+	emergencyChangeReason:     "",
+	debug:                     (os.Getenv("DEBUG") == "true"),
+	verbose:                   false,
+}
+
+// stringList is a flag.Value collecting values given one per line or by
+// repeating the flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, "\n")
+}
+
+func (s *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, "\n") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// terraformDirPatterns returns the terraform dirs (or globs) given one per line.
+func (o *options) terraformDirPatterns() []string {
+	var patterns stringList
+	_ = patterns.Set(o.terraformDir)
+	return patterns
 }
 
 func deployTerraformFromOptions(opts *options, out, err io.Writer) *deployTerraform {
@@ -107,35 +315,157 @@ func deployTerraformFromOptions(opts *options, out, err io.Writer) *deployTerraf
 		opts:         opts,
 		outWriter:    out,
 		errWriter:    err,
+
+		approvalPollInterval: defaultApprovalPollInterval,
+		now:                  time.Now,
 	}
 }
 
-func main() {
-	opts := options{}
-	flag.StringVar(&opts.checkoutDir, "checkout-dir", defaultOptions.checkoutDir, "Checkout dir")
-	flag.StringVar(&opts.terraformDir, "terraform-dir", defaultOptions.terraformDir, "Terraform files directory")
-	flag.StringVar(&opts.targetEnvironment, "target-environment", defaultOptions.targetEnvironment, "Identified target environment for terraform resources to apply to. Also used in the name of the Terraform state file (tfstate-{terraform-workspace}-{target-environment})")
-	flag.BoolVar(&opts.envFromSecret, "env-from-secret", defaultOptions.envFromSecret, "Whether to derive env variables from the k8s secret terraform-var-`target-environment`")
-	flag.BoolVar(&opts.planOnly, "plan-only", defaultOptions.planOnly, "Whether to perform only a terraform plan")
-	flag.StringVar(&opts.applyExtraArgs, "apply-extra-args", defaultOptions.applyExtraArgs, "Extra arguments to pass to `terraform apply`")
-	flag.StringVar(&opts.planExtraArgs, "plan-extra-args", defaultOptions.planExtraArgs, "Extra arguments to pass to `terraform plan`")
-	flag.BoolVar(&opts.debug, "debug", defaultOptions.debug, "debug mode enables debug loggers and debug parameter passed into executed commands if available.")
-	flag.BoolVar(&opts.verbose, "verbose", defaultOptions.verbose, "verbose mode. debug implies verbose.")
-	flag.Parse()
+// addFlags registers the options shared by all commands with fs.
+func addFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.checkoutDir, "checkout-dir", defaultOptions.checkoutDir, "Checkout dir")
+	fs.StringVar(&opts.kubeconfig, "kubeconfig", defaultOptions.kubeconfig, "Kubeconfig file to use instead of the in-cluster config, e.g. to run outside of the cluster")
+	fs.StringVar(&opts.kubeContext, "kube-context", defaultOptions.kubeContext, "Kubeconfig context to use instead of the in-cluster config. The standard loading rules (KUBECONFIG, ~/.kube/config) apply if no kubeconfig is given")
+	fs.StringVar(&opts.stateNamespace, "state-namespace", defaultOptions.stateNamespace, "Namespace in which the Terraform state is stored. Defaults to the namespace of the pipeline")
+	fs.StringVar(&opts.secretsNamespace, "secrets-namespace", defaultOptions.secretsNamespace, "Namespace from which Secrets and ConfigMaps (env sources) are read. Defaults to the namespace of the pipeline")
+	fs.StringVar(&opts.stateSecretSuffix, "state-secret-suffix", defaultOptions.stateSecretSuffix, "Naming template of the state secret suffix. Available fields are .Project, .Repository, .Component, .Subrepo, .Environment and .TerraformDir")
+	fs.StringVar(&opts.subrepoStateSecretSuffix, "subrepo-state-secret-suffix", defaultOptions.subrepoStateSecretSuffix, "Naming template of the state secret suffix of terraform configs in subrepos. Same fields as for state-secret-suffix")
+	fs.Var(&opts.stateLabels, "state-labels", "Labels (key=value) added to the state secrets. One label per line")
+	fs.StringVar(&opts.migrateStateFrom, "migrate-state-from", defaultOptions.migrateStateFrom, "Naming template of a previous state secret suffix. Existing state with that suffix is moved to the current suffix once changes are applied")
+	fs.StringVar(&opts.backend, "backend", defaultOptions.backend, "Backend to store the Terraform state in, kubernetes or s3")
+	fs.StringVar(&opts.s3Bucket, "s3-bucket", defaultOptions.s3Bucket, "S3 bucket to store the Terraform state in if backend is s3")
+	fs.StringVar(&opts.s3KeyPrefix, "s3-key-prefix", defaultOptions.s3KeyPrefix, "Prefix of the state object key (<prefix>/<state-secret-suffix>/terraform.tfstate) in the S3 bucket")
+	fs.StringVar(&opts.s3Region, "s3-region", defaultOptions.s3Region, "Region of the S3 bucket. Defaults to env variable AWS_REGION")
+	fs.StringVar(&opts.s3DynamoDBTable, "s3-dynamodb-table", defaultOptions.s3DynamoDBTable, "DynamoDB table used for state locking with the s3 backend")
+	opts.stateSizeWarnThresholds = append(stateSizeThresholds{}, defaultOptions.stateSizeWarnThresholds...)
+	fs.Var(&opts.stateSizeWarnThresholds, "state-size-warn-thresholds", "Comma-separated percentages of the 1 MiB size limit of Kubernetes secrets at which to warn about the size of the state secret at the end of the run")
+	fs.StringVar(&opts.stateSizeResult, "state-size-result", defaultOptions.stateSizeResult, "File to write the size of the largest state secret (in bytes) to at the end of the run")
+	fs.StringVar(&opts.terraformDir, "terraform-dir", defaultOptions.terraformDir, "Terraform files directories or globs (e.g. infra/*), one per line. Configurations are processed in the given order")
+	fs.StringVar(&opts.targetEnvironment, "target-environment", defaultOptions.targetEnvironment, "Identified target environment for terraform resources to apply to. Also used in the name of the Terraform state file (tfstate-{terraform-workspace}-{target-environment})")
+	fs.StringVar(&opts.stage, "stage", defaultOptions.stage, "Stage (dev, qa or prod) of the target environment, used to select stage-level .tfvars files. Derived from the suffix of target-environment if empty")
+	fs.StringVar(&opts.workspace, "workspace", defaultOptions.workspace, "Terraform workspace to select (created if it does not exist). Leave empty to use the default workspace")
+	fs.StringVar(&opts.build, "build", defaultOptions.build, "Identifier of the build (e.g. the TaskRun name), exposed to Terraform as variable ods_build if declared")
+	fs.BoolVar(&opts.envFromSecret, "env-from-secret", defaultOptions.envFromSecret, "Whether to derive env variables from the k8s secret terraform-var-`target-environment`")
+	fs.Var(&opts.envSources, "env-sources", "Additional Secrets and ConfigMaps to derive env variables from, given as <kind>:<name>[:<prefix>] with kind secret or configmap. One source per line, later sources take precedence")
+	fs.Var(&opts.envFiles, "env-files", "Keys of the env sources to write into files, given as <name>[=<key>]. Env variable <name> is set to the path of the file holding the value of <key>. One per line")
+	fs.BoolVar(&opts.failOnEnvConflict, "fail-on-env-conflict", defaultOptions.failOnEnvConflict, "Whether to fail if a key is defined by more than one env source instead of only warning")
+	fs.StringVar(&opts.vaultAddr, "vault-addr", defaultOptions.vaultAddr, "Address of the Vault server used for env sources of kind vault. Defaults to env variable VAULT_ADDR")
+	fs.StringVar(&opts.vaultRole, "vault-role", defaultOptions.vaultRole, "Vault role to login with using the Kubernetes auth method")
+	fs.StringVar(&opts.vaultAuthPath, "vault-auth-path", defaultOptions.vaultAuthPath, "Path at which the Kubernetes auth method is mounted in Vault")
+	fs.StringVar(&opts.vaultKVMount, "vault-kv-mount", defaultOptions.vaultKVMount, "Mount path of the KV version 2 secrets engine in Vault")
+	fs.Var(&opts.workloadIdentities, "workload-identity", "Exchange the service account token for short-lived cloud credentials, given as [<env>=]<provider>:<arg>[:<arg>] with provider aws (role ARN), azure (tenant ID, client ID) or gcp (workload identity pool provider, optional service account). One per line, entries for the target environment take precedence")
+	fs.StringVar(&opts.workloadIdentityTokenFile, "workload-identity-token-file", defaultOptions.workloadIdentityTokenFile, "File containing the service account token used for workload identity")
+	fs.StringVar(&opts.mode, "mode", defaultOptions.mode, "Mode of operation: plan-apply (plan and apply), plan (plan and save plan bundles) or apply-plan (apply the plan bundles saved by an earlier run)")
+	fs.BoolVar(&opts.planOnly, "plan-only", defaultOptions.planOnly, "Whether to perform only a terraform plan")
+	fs.Var(&opts.applyRefs, "apply-refs", "Full git refs (or patterns such as refs/tags/v*) from which changes are applied, e.g. refs/heads/main. If set, pipeline runs for other refs and for pull requests only plan. One per line")
+	fs.Var(&opts.varFiles, "var-files", "Additional .tfvars files (relative to the terraform directory) passed via -var-file. One file per line, can be repeated")
+	fs.Var(&opts.vars, "vars", "Additional input variables (name=value) passed via -var. Use name=secret:KEY to take the value from key KEY of the env secret. One variable per line, can be repeated")
+	fs.StringVar(&opts.applyExtraArgs, "apply-extra-args", defaultOptions.applyExtraArgs, "Extra arguments to pass to `terraform apply`")
+	fs.StringVar(&opts.planExtraArgs, "plan-extra-args", defaultOptions.planExtraArgs, "Extra arguments to pass to `terraform plan`")
+	fs.StringVar(&opts.lockTimeout, "lock-timeout", defaultOptions.lockTimeout, "Duration (e.g. 5m) to retry acquiring the state lock during terraform plan and apply")
+	fs.IntVar(&opts.parallelism, "parallelism", defaultOptions.parallelism, "Number of concurrent operations of terraform plan and apply. 0 uses the terraform default")
+	fs.BoolVar(&opts.preventDestroy, "prevent-destroy", defaultOptions.preventDestroy, "Whether to fail instead of applying a plan which destroys resources")
+	fs.BoolVar(&opts.requireApproval, "require-approval", defaultOptions.requireApproval, "Whether to wait for manual approval (via a ConfigMap in the pipeline namespace) of the plan before applying it")
+	fs.StringVar(&opts.approvalTimeout, "approval-timeout", defaultOptions.approvalTimeout, "Duration (e.g. 30m) to wait for approval of the plan before failing")
+	fs.Var(&opts.changeWindows, "change-windows", "Change windows of the target environment outside of which changes are not applied, given as [<days>] <start>-<end> [<time zone>], e.g. Mon-Thu,Sat 09:00-16:00 Europe/Berlin. One per line")
+	fs.StringVar(&opts.outsideChangeWindow, "outside-change-window", defaultOptions.outsideChangeWindow, "What to do when applying outside of the change windows of the target environment: fail or plan-only")
+	fs.BoolVar(&opts.emergencyChange, "emergency-change", defaultOptions.emergencyChange, "Whether to apply outside of the change windows of the target environment")
+	fs.StringVar(&opts.emergencyChangeReason, "emergency-change-reason", defaultOptions.emergencyChangeReason, "Reason of the emergency change, required with emergency-change")
+	fs.BoolVar(&opts.debug, "debug", defaultOptions.debug, "debug mode enables debug loggers and debug parameter passed into executed commands if available.")
+	fs.BoolVar(&opts.verbose, "verbose", defaultOptions.verbose, "verbose mode. debug implies verbose.")
+}
 
-	dt := deployTerraformFromOptions(&opts, os.Stdout, os.Stderr)
-	err := (dt).runSteps(
+// emptyFlagPattern matches a flag given with an empty value, e.g. -stage=.
+var emptyFlagPattern = regexp.MustCompile(`^--?[^-=][^=]*=$`)
+
+// parseFlags parses args into opts, whose flags must have been registered
+// with fs by addFlags. Flags given with an empty value are ignored, as the
+// task passes every parameter, empty if not set. The names of all other flags
+// given are recorded in opts.explicitFlags.
+func parseFlags(fs *flag.FlagSet, opts *options, args []string) error {
+	given := []string{}
+	for _, a := range args {
+		if !emptyFlagPattern.MatchString(a) {
+			given = append(given, a)
+		}
+	}
+	if err := fs.Parse(given); err != nil {
+		return err
+	}
+	opts.explicitFlags = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		opts.explicitFlags[f.Name] = true
+	})
+	return nil
+}
+
+// stepsForMode returns the steps to run in the given mode.
+func stepsForMode(mode string) ([]TerraformStep, error) {
+	setup := []TerraformStep{
+		loadODSConfig(),
 		setupContext(),
+		selectPlanMode(),
+		precheckChangeWindow(),
+		checkPermissions(),
 		setupEnvFromSecret(),
-		collectVarFiles(),
-		renderBackend(),
+		setupWorkloadIdentity(),
+		setupEnvFiles(),
 		detectSubrepos(),
 		detectDeploymentArtifacts(),
 		locateTerraformConfigs(),
+		setupStateSecret(),
+		checkStateSize(),
+		prepareWorkDirs(),
+	}
+	plan := []TerraformStep{
+		collectVarFiles(),
+		collectInputVars(),
+		collectContextVars(),
+		checkRequiredVariables(),
 		initTerraform(),
 		planTerraform(),
-		applyTerraform(),
-	)
+		checkPolicies(),
+	}
+	switch mode {
+	case modePlanApply:
+		return append(append(setup, plan...),
+			awaitApproval(),
+			refreshWorkloadIdentity(),
+			applyTerraform(),
+			migrateStateSecrets(),
+		), nil
+	case modePlan:
+		return append(append(setup, plan...),
+			savePlanBundles(),
+		), nil
+	case modeApplyPlan:
+		return append(setup,
+			restorePlanBundles(),
+			initTerraform(),
+			verifyPlanBundles(),
+			checkPolicies(),
+			awaitApproval(),
+			refreshWorkloadIdentity(),
+			applyTerraform(),
+			migrateStateSecrets(),
+		), nil
+	}
+	return nil, fmt.Errorf("unknown mode %s, must be one of %s, %s or %s", mode, modePlanApply, modePlan, modeApplyPlan)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == migrateStateCommand {
+		os.Exit(migrateStateMain(os.Args[2:]))
+	}
+	opts := options{}
+	addFlags(flag.CommandLine, &opts)
+	_ = parseFlags(flag.CommandLine, &opts, os.Args[1:])
+
+	dt := deployTerraformFromOptions(&opts, os.Stdout, os.Stderr)
+	steps, err := stepsForMode(opts.mode)
+	if err == nil {
+		err = (dt).runSteps(steps...)
+	}
 	if err != nil {
 		dt.logger.Errorf(err.Error())
 		os.Exit(1)
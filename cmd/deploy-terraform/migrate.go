@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const migrateStateCommand = "migrate-state"
+
+// migrateStateMain runs the migrate-state command with the given arguments
+// and returns the exit code.
+func migrateStateMain(args []string) int {
+	opts := options{}
+	fs := flag.NewFlagSet(migrateStateCommand, flag.ExitOnError)
+	addFlags(fs, &opts)
+	from := fs.String("from", backendKubernetes, "Backend to migrate the Terraform state from, kubernetes or s3")
+	to := fs.String("to", backendS3, "Backend to migrate the Terraform state to, kubernetes or s3")
+	force := fs.Bool("force", false, "Whether to migrate even if the state in the backend to migrate from has no resources or the state in the backend to migrate to has resources already")
+	_ = parseFlags(fs, &opts, args)
+
+	dt := deployTerraformFromOptions(&opts, os.Stdout, os.Stderr)
+	err := (dt).runSteps(
+		loadODSConfig(),
+		setupContext(),
+		setupEnvFromSecret(),
+		setupWorkloadIdentity(),
+		setupEnvFiles(),
+		detectSubrepos(),
+		detectDeploymentArtifacts(),
+		locateTerraformConfigs(),
+		setupStateSecret(),
+		prepareWorkDirs(),
+		migrateBackendState(*from, *to, *force),
+	)
+	if err != nil {
+		dt.logger.Errorf(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// migrateBackendState copies the state of each terraform config from one
+// backend to another using "terraform init -migrate-state". As "-force-copy"
+// copies all workspaces, the number of resources in the state of each
+// workspace is compared before and after the migration. Unless force is set,
+// migrating state without resources in the configured workspace fails, as
+// this hints at a wrong backend configuration or workspace, and so does
+// migrating to a backend which holds state with resources already in any
+// workspace, as that state would be overwritten (e.g. newer state by a stale
+// copy when migrating again). The state in the original backend is left in
+// place as a backup.
+func migrateBackendState(from, to string, force bool) TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if from == to {
+			return d, fmt.Errorf("cannot migrate state from backend %s to itself", from)
+		}
+		workspace := d.opts.workspace
+		if workspace == "" {
+			workspace = "default"
+		}
+		for _, tfConfig := range d.tfConfigs {
+			dir := tfConfig.workDir
+			d.logger.Infof("Migrating state of %s from backend %s to %s ...", tfConfig.terraformDir, from, to)
+			if err := d.renderBackend(to, dir, tfConfig.secretSuffix); err != nil {
+				return d, fmt.Errorf("render backend %s: %w", to, err)
+			}
+			initArgs, initEnv, sensitive, err := d.assembleInitWithK8sBackendArgsEnv()
+			if err != nil {
+				return d, fmt.Errorf("assemble terraform init args/env: %w", err)
+			}
+			printlnTerraformCmd(initArgs, initEnv, sensitive, dir, d.outWriter)
+			if err := d.terraformCmd(initArgs, initEnv, dir, d.outWriter, d.errWriter); err != nil {
+				return d, fmt.Errorf("terraform init with backend %s: %w", to, err)
+			}
+			existing, err := d.workspaceResourceCounts(dir)
+			if err != nil {
+				return d, fmt.Errorf("count resources in backend %s: %w", to, err)
+			}
+			if nonEmpty := existing.nonEmpty(); len(nonEmpty) > 0 && !force {
+				return d, fmt.Errorf("state of %s has resources in backend %s already (workspaces %s), refusing to overwrite it (use -force to migrate anyway)", tfConfig.terraformDir, to, nonEmpty)
+			}
+
+			if err := d.renderBackend(from, dir, tfConfig.secretSuffix); err != nil {
+				return d, fmt.Errorf("render backend %s: %w", from, err)
+			}
+			reconfigureArgs, reconfigureEnv, sensitive, err := d.assembleReconfigureArgsEnv()
+			if err != nil {
+				return d, fmt.Errorf("assemble terraform init -reconfigure args/env: %w", err)
+			}
+			printlnTerraformCmd(reconfigureArgs, reconfigureEnv, sensitive, dir, d.outWriter)
+			if err := d.terraformCmd(reconfigureArgs, reconfigureEnv, dir, d.outWriter, d.errWriter); err != nil {
+				return d, fmt.Errorf("terraform init with backend %s: %w", from, err)
+			}
+			before, err := d.workspaceResourceCounts(dir)
+			if err != nil {
+				return d, fmt.Errorf("count resources in backend %s: %w", from, err)
+			}
+			count, ok := before.count(workspace)
+			if !ok {
+				return d, fmt.Errorf("workspace %s of %s does not exist in backend %s", workspace, tfConfig.terraformDir, from)
+			}
+			if count == 0 && !force {
+				return d, fmt.Errorf("state of %s has no resources in backend %s, refusing to migrate (use -force to migrate anyway)", tfConfig.terraformDir, from)
+			}
+
+			if err := d.renderBackend(to, dir, tfConfig.secretSuffix); err != nil {
+				return d, fmt.Errorf("render backend %s: %w", to, err)
+			}
+			migrateArgs, migrateEnv, sensitive, err := d.assembleMigrateStateArgsEnv()
+			if err != nil {
+				return d, fmt.Errorf("assemble terraform init -migrate-state args/env: %w", err)
+			}
+			printlnTerraformCmd(migrateArgs, migrateEnv, sensitive, dir, d.outWriter)
+			if err := d.terraformCmd(migrateArgs, migrateEnv, dir, d.outWriter, d.errWriter); err != nil {
+				return d, fmt.Errorf("terraform init -migrate-state to backend %s: %w", to, err)
+			}
+			after, err := d.workspaceResourceCounts(dir)
+			if err != nil {
+				return d, fmt.Errorf("count resources in backend %s: %w", to, err)
+			}
+			mismatches := []string{}
+			for _, w := range before {
+				if got, _ := after.count(w.name); got != w.count {
+					mismatches = append(mismatches, fmt.Sprintf("workspace %s has %d resources in backend %s but %d in backend %s", w.name, w.count, from, got, to))
+				}
+			}
+			if len(mismatches) > 0 {
+				return d, fmt.Errorf("state of %s was not migrated completely: %s", tfConfig.terraformDir, strings.Join(mismatches, "; "))
+			}
+			d.logger.Infof("Migrated state of %s (workspaces %s) from backend %s to %s. The state in backend %s is left in place as a backup.", tfConfig.terraformDir, after, from, to, from)
+		}
+		return d, nil
+	}
+}
+
+// workspaceResources is the number of resources in the state of a workspace.
+type workspaceResources struct {
+	name  string
+	count int
+}
+
+// workspaceResourceList lists the workspaces of a backend in the order
+// terraform lists them.
+type workspaceResourceList []workspaceResources
+
+func (l workspaceResourceList) String() string {
+	values := []string{}
+	for _, w := range l {
+		values = append(values, fmt.Sprintf("%s (%d resources)", w.name, w.count))
+	}
+	return strings.Join(values, ", ")
+}
+
+// count returns the number of resources in workspace name and whether the
+// workspace exists.
+func (l workspaceResourceList) count(name string) (int, bool) {
+	for _, w := range l {
+		if w.name == name {
+			return w.count, true
+		}
+	}
+	return 0, false
+}
+
+// nonEmpty returns the workspaces with resources.
+func (l workspaceResourceList) nonEmpty() workspaceResourceList {
+	nonEmpty := workspaceResourceList{}
+	for _, w := range l {
+		if w.count > 0 {
+			nonEmpty = append(nonEmpty, w)
+		}
+	}
+	return nonEmpty
+}
+
+// stateResourceCount selects the given workspace (if any) and returns the
+// number of resources in its state. Selecting a workspace which does not
+// exist fails.
+func (d *deployTerraform) stateResourceCount(dir, workspace string) (int, error) {
+	if workspace != "" {
+		if err := d.selectWorkspace(dir, workspace); err != nil {
+			return 0, err
+		}
+	}
+	args, env, sensitive, err := d.assembleStateListArgsEnv()
+	if err != nil {
+		return 0, fmt.Errorf("assemble terraform state list args/env: %w", err)
+	}
+	printlnTerraformCmd(args, env, sensitive, dir, d.outWriter)
+	var out bytes.Buffer
+	if err := d.terraformCmd(args, env, dir, &out, d.errWriter); err != nil {
+		return 0, fmt.Errorf("terraform state list: %w", err)
+	}
+	count := 0
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// workspaceResourceCounts returns the number of resources in the state of
+// every workspace of the initialised backend. Afterwards, the default
+// workspace is selected again, as it exists in every backend.
+func (d *deployTerraform) workspaceResourceCounts(dir string) (workspaceResourceList, error) {
+	args, env, sensitive, err := d.assembleWorkspaceListArgsEnv()
+	if err != nil {
+		return nil, fmt.Errorf("assemble terraform workspace list args/env: %w", err)
+	}
+	printlnTerraformCmd(args, env, sensitive, dir, d.outWriter)
+	var out bytes.Buffer
+	if err := d.terraformCmd(args, env, dir, &out, d.errWriter); err != nil {
+		return nil, fmt.Errorf("terraform workspace list: %w", err)
+	}
+	counts := workspaceResourceList{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		workspace := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*"))
+		if workspace == "" {
+			continue
+		}
+		count, err := d.stateResourceCount(dir, workspace)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, workspaceResources{name: workspace, count: count})
+	}
+	if err := d.selectWorkspace(dir, "default"); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// selectWorkspace selects the given existing workspace.
+func (d *deployTerraform) selectWorkspace(dir, workspace string) error {
+	args, env, sensitive, err := d.assembleWorkspaceSelectArgsEnv(workspace, false)
+	if err != nil {
+		return fmt.Errorf("assemble terraform workspace select args/env: %w", err)
+	}
+	printlnTerraformCmd(args, env, sensitive, dir, d.outWriter)
+	if err := d.terraformCmd(args, env, dir, d.outWriter, d.errWriter); err != nil {
+		return fmt.Errorf("terraform workspace select: %w", err)
+	}
+	return nil
+}
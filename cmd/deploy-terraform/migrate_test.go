@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+// fakeTerraform writes a script standing in for terraform which records its
+// invocations in a log file and tracks the selected workspace. For the
+// backend configured in the working directory, it lists the workspaces
+// (default and those given for the backend) and the resources of the
+// selected workspace, keyed by "<backend>/<workspace>": those given in before
+// until "terraform init -migrate-state" ran, those given in after afterwards.
+func fakeTerraform(t *testing.T, before, after map[string]string) (bin, log string) {
+	dir := t.TempDir()
+	log = filepath.Join(dir, "log")
+	migrated := filepath.Join(dir, "migrated")
+	selected := filepath.Join(dir, "selected")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n" +
+		"case \"$*\" in *-migrate-state*) touch " + migrated + " ;; esac\n" +
+		"if [ \"$1 $2\" = \"workspace select\" ]; then for a; do ws=$a; done; echo $ws > " + selected + "; fi\n" +
+		"ws=default; if [ -f " + selected + " ]; then ws=$(cat " + selected + "); fi\n" +
+		"list=\nworkspaces=\n"
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	sortedKeys := []string{}
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+	for _, k := range sortedKeys {
+		backend, workspace, _ := strings.Cut(k, "/")
+		script += "if [ -f " + backendFilename(backend) + " ]; then\n" +
+			"  if [ -f " + migrated + " ]; then l='" + after[k] + "'; else l='" + before[k] + "'; fi\n" +
+			"  if [ \"$ws\" = " + workspace + " ]; then list=$l; fi\n" +
+			"  if [ " + workspace + " != default ]; then workspaces=\"$workspaces  " + workspace + "\\n\"; fi\n" +
+			"fi\n"
+	}
+	script += "if [ \"$1\" = state ]; then printf \"$list\"; fi\n" +
+		"if [ \"$1 $2\" = \"workspace list\" ]; then printf \"* default\\n$workspaces\"; fi\n"
+	bin = filepath.Join(dir, "terraform")
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return bin, log
+}
+
+func TestMigrateBackendState(t *testing.T) {
+	resources := "aws_s3_bucket.a\\naws_s3_bucket.b\\n"
+	k8sFeature := backendKubernetes + "/feature"
+	s3Feature := backendS3 + "/feature"
+	k8sOther := backendKubernetes + "/other"
+	s3Other := backendS3 + "/other"
+	tests := map[string]struct {
+		before    map[string]string
+		after     map[string]string
+		force     bool
+		wantErr   string
+		wantCalls []string
+	}{
+		"same resource count": {
+			before: map[string]string{k8sFeature: resources},
+			after:  map[string]string{k8sFeature: resources, s3Feature: resources},
+			wantCalls: []string{
+				"init -input=false -no-color",
+				"workspace list -no-color",
+				"workspace select -no-color default",
+				"state list",
+				"workspace select -no-color feature",
+				"state list",
+				"workspace select -no-color default",
+				"init -input=false -no-color -reconfigure",
+				"workspace list -no-color",
+				"workspace select -no-color default",
+				"state list",
+				"workspace select -no-color feature",
+				"state list",
+				"workspace select -no-color default",
+				"init -input=false -no-color -migrate-state -force-copy",
+				"workspace list -no-color",
+				"workspace select -no-color default",
+				"state list",
+				"workspace select -no-color feature",
+				"state list",
+				"workspace select -no-color default",
+			},
+		},
+		"resources missing after migration": {
+			before:  map[string]string{k8sFeature: resources},
+			after:   map[string]string{k8sFeature: resources, s3Feature: "aws_s3_bucket.a\\n"},
+			wantErr: "state of terraform was not migrated completely: workspace feature has 2 resources in backend kubernetes but 1 in backend s3",
+		},
+		"resources of another workspace missing after migration": {
+			before:  map[string]string{k8sFeature: resources, k8sOther: resources},
+			after:   map[string]string{k8sFeature: resources, k8sOther: resources, s3Feature: resources, s3Other: "aws_s3_bucket.a\\n"},
+			wantErr: "state of terraform was not migrated completely: workspace other has 2 resources in backend kubernetes but 1 in backend s3",
+		},
+		"workspace missing in backend to migrate from": {
+			before:  map[string]string{k8sOther: resources},
+			after:   map[string]string{k8sOther: resources, s3Other: resources},
+			wantErr: "workspace feature of terraform does not exist in backend kubernetes",
+		},
+		"no resources": {
+			before:  map[string]string{k8sFeature: ""},
+			wantErr: "state of terraform has no resources in backend kubernetes, refusing to migrate (use -force to migrate anyway)",
+		},
+		"no resources with force": {
+			before: map[string]string{k8sFeature: ""},
+			force:  true,
+		},
+		"state in backend to migrate to": {
+			before:  map[string]string{k8sFeature: resources, s3Feature: "aws_s3_bucket.a\\n"},
+			after:   map[string]string{k8sFeature: resources, s3Feature: resources},
+			wantErr: "state of terraform has resources in backend s3 already (workspaces feature (1 resources)), refusing to overwrite it (use -force to migrate anyway)",
+		},
+		"state of another workspace in backend to migrate to": {
+			before:  map[string]string{k8sFeature: resources, backendS3 + "/default": "aws_s3_bucket.a\\n", s3Other: resources},
+			after:   map[string]string{k8sFeature: resources, s3Feature: resources},
+			wantErr: "state of terraform has resources in backend s3 already (workspaces default (1 resources), other (2 resources)), refusing to overwrite it (use -force to migrate anyway)",
+		},
+		"state in backend to migrate to with force": {
+			before: map[string]string{k8sFeature: resources, s3Feature: "aws_s3_bucket.a\\n"},
+			after:  map[string]string{k8sFeature: resources, s3Feature: resources},
+			force:  true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			bin, log := fakeTerraform(t, tc.before, tc.after)
+			dir := t.TempDir()
+			opts := &options{terraformDir: dir, s3Bucket: "tfstate", workspace: "feature"}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.terraformBin = bin
+			d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+			d.tfConfigs = []terraformConfig{{terraformDir: "terraform", workDir: dir, secretSuffix: "foo-dev"}}
+			_, err := migrateBackendState(backendKubernetes, backendS3, tc.force)(d)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if tc.wantCalls != nil {
+				calls, err := os.ReadFile(log)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tc.wantCalls, strings.Split(strings.TrimSpace(string(calls)), "\n")); diff != "" {
+					t.Fatalf("calls mismatch (-want +got):\n%s", diff)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, backendFilename(backendS3))); err != nil {
+				t.Fatalf("want s3 backend rendered, got %s", err)
+			}
+		})
+	}
+
+	if _, err := migrateBackendState(backendS3, backendS3, false)(deployTerraformFromOptions(&options{}, io.Discard, io.Discard)); err == nil {
+		t.Fatal("want err for same backend, got none")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline/pkg/config"
+	"sigs.k8s.io/yaml"
+)
+
+// odsTerraformSettings are the settings of the terraform section of
+// ods.yaml, which may also be given per environment.
+type odsTerraformSettings struct {
+	Dirs             []string `json:"dirs"`
+	Backend          string   `json:"backend"`
+	S3               odsS3    `json:"s3"`
+	StateNamespace   string   `json:"stateNamespace"`
+	SecretsNamespace string   `json:"secretsNamespace"`
+	Stage            string   `json:"stage"`
+	Workspace        string   `json:"workspace"`
+	EnvSources       []string `json:"envSources"`
+	VarFiles         []string `json:"varFiles"`
+	Vars             []string `json:"vars"`
+	PlanExtraArgs    string   `json:"planExtraArgs"`
+	ApplyExtraArgs   string   `json:"applyExtraArgs"`
+	PlanOnly         *bool    `json:"planOnly"`
+	LockTimeout      string   `json:"lockTimeout"`
+	Parallelism      int      `json:"parallelism"`
+	// Guards are checked before applying changes, regardless of whether the
+	// environment is protected.
+	Guards          odsTerraformPolicies `json:"guards"`
+	RequireApproval *bool                `json:"requireApproval"`
+	ApprovalTimeout string               `json:"approvalTimeout"`
+	// ChangeWindows are the only times at which changes are applied.
+	ChangeWindows       []odsChangeWindow `json:"changeWindows"`
+	OutsideChangeWindow string            `json:"outsideChangeWindow"`
+}
+
+// odsS3 are the settings of the s3 backend.
+type odsS3 struct {
+	Bucket        string `json:"bucket"`
+	KeyPrefix     string `json:"keyPrefix"`
+	Region        string `json:"region"`
+	DynamoDBTable string `json:"dynamodbTable"`
+}
+
+// odsTerraformPolicies are checked before applying changes to a protected
+// environment.
+type odsTerraformPolicies struct {
+	// PreventDestroy fails the task if the plan destroys (or replaces)
+	// resources.
+	PreventDestroy bool `json:"preventDestroy"`
+}
+
+// odsTerraformProfile are settings for all target environments matching
+// one of its patterns.
+type odsTerraformProfile struct {
+	odsTerraformSettings
+	Name string `json:"name"`
+	// Match are names or patterns (e.g. *-prod) of target environments.
+	Match []string `json:"match"`
+}
+
+// odsTerraformConfig is the terraform section of ods.yaml.
+type odsTerraformConfig struct {
+	odsTerraformSettings
+	// Profiles hold settings overriding the ones above. The first profile
+	// matching the target environment is used.
+	Profiles []odsTerraformProfile `json:"profiles"`
+	// Environments holds settings overriding the ones above and of profiles,
+	// by name of the target environment.
+	Environments map[string]odsTerraformSettings `json:"environments"`
+	// ProtectedEnvironments are names or patterns (e.g. *-prod) of the target
+	// environments to which policies apply.
+	ProtectedEnvironments []string `json:"protectedEnvironments"`
+	// Policies applying to protected environments.
+	Policies odsTerraformPolicies `json:"policies"`
+}
+
+// readODSTerraformConfig reads the terraform section of the ods.y(a)ml file
+// in dir. It returns nil if there is no such file or section. Unknown keys in
+// the terraform section are an error, other sections are ignored.
+func readODSTerraformConfig(dir string) (*odsTerraformConfig, error) {
+	for _, candidate := range config.ODSFileCandidates {
+		filename := filepath.Join(dir, candidate)
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("read %s: %w", filename, err)
+		}
+		var sections struct {
+			Terraform json.RawMessage `json:"terraform"`
+		}
+		if err := yaml.Unmarshal(content, &sections); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", filename, err)
+		}
+		if len(sections.Terraform) == 0 || string(sections.Terraform) == "null" {
+			return nil, nil
+		}
+		c := &odsTerraformConfig{}
+		dec := json.NewDecoder(bytes.NewReader(sections.Terraform))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("parse terraform section of %s: %w", filename, err)
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+// settingsFor returns the settings for targetEnvironment: the top-level
+// settings, overridden by the ones of the matching profile (if any), in turn
+// overridden by the ones of the environment. The name of the matching profile
+// is returned as well.
+func (c *odsTerraformConfig) settingsFor(targetEnvironment string) (odsTerraformSettings, string, error) {
+	s := c.odsTerraformSettings
+	profile := ""
+	for _, p := range c.Profiles {
+		ok, err := matchAny(p.Match, targetEnvironment)
+		if err != nil {
+			return s, "", fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		if ok {
+			s = s.overlay(p.odsTerraformSettings)
+			profile = p.Name
+			break
+		}
+	}
+	if e, ok := c.Environments[targetEnvironment]; ok {
+		s = s.overlay(e)
+	}
+	return s, profile, nil
+}
+
+// overlay returns s overridden by the settings given in o. Lists of o are
+// appended to the ones of s, except for dirs and changeWindows, which
+// replace them.
+func (s odsTerraformSettings) overlay(o odsTerraformSettings) odsTerraformSettings {
+	if len(o.Dirs) > 0 {
+		s.Dirs = o.Dirs
+	}
+	if len(o.ChangeWindows) > 0 {
+		s.ChangeWindows = o.ChangeWindows
+	}
+	overrideString(&s.Backend, o.Backend)
+	overrideString(&s.S3.Bucket, o.S3.Bucket)
+	overrideString(&s.S3.KeyPrefix, o.S3.KeyPrefix)
+	overrideString(&s.S3.Region, o.S3.Region)
+	overrideString(&s.S3.DynamoDBTable, o.S3.DynamoDBTable)
+	overrideString(&s.StateNamespace, o.StateNamespace)
+	overrideString(&s.SecretsNamespace, o.SecretsNamespace)
+	overrideString(&s.Stage, o.Stage)
+	overrideString(&s.Workspace, o.Workspace)
+	overrideString(&s.PlanExtraArgs, o.PlanExtraArgs)
+	overrideString(&s.ApplyExtraArgs, o.ApplyExtraArgs)
+	overrideString(&s.LockTimeout, o.LockTimeout)
+	overrideString(&s.ApprovalTimeout, o.ApprovalTimeout)
+	overrideString(&s.OutsideChangeWindow, o.OutsideChangeWindow)
+	s.EnvSources = append(append([]string{}, s.EnvSources...), o.EnvSources...)
+	s.VarFiles = append(append([]string{}, s.VarFiles...), o.VarFiles...)
+	s.Vars = append(append([]string{}, s.Vars...), o.Vars...)
+	if o.PlanOnly != nil {
+		s.PlanOnly = o.PlanOnly
+	}
+	if o.RequireApproval != nil {
+		s.RequireApproval = o.RequireApproval
+	}
+	if o.Parallelism > 0 {
+		s.Parallelism = o.Parallelism
+	}
+	if o.Guards.PreventDestroy {
+		s.Guards.PreventDestroy = true
+	}
+	return s
+}
+
+// isProtectedEnvironment returns whether targetEnvironment matches one of the
+// protected environments.
+func (c *odsTerraformConfig) isProtectedEnvironment(targetEnvironment string) (bool, error) {
+	ok, err := matchAny(c.ProtectedEnvironments, targetEnvironment)
+	if err != nil {
+		return false, fmt.Errorf("protected environments: %w", err)
+	}
+	return ok, nil
+}
+
+// matchAny returns whether name matches one of the names or patterns.
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func overrideString(s *string, value string) {
+	if value != "" {
+		*s = value
+	}
+}
+
+// mergeInto sets the options which were not given as flags to the values of
+// s, so that flags take precedence over ods.yaml. The safety settings
+// planOnly, requireApproval and guards.preventDestroy are the exception: as
+// ods.yaml is part of the commit being deployed, they can only tighten the
+// options (e.g. plan only although plan-only is false), never loosen them. It
+// returns the names of the options taken from s.
+func (s odsTerraformSettings) mergeInto(opts *options) []string {
+	merged := []string{}
+	merge := func(name, flagName string, given bool, set func()) {
+		if !given || opts.explicitFlags[flagName] {
+			return
+		}
+		set()
+		merged = append(merged, name)
+	}
+	tighten := func(name string, opt *bool, value *bool) {
+		if value == nil || !*value || *opt {
+			return
+		}
+		*opt = true
+		merged = append(merged, name)
+	}
+	mergeString := func(name, flagName string, opt *string, value string) {
+		merge(name, flagName, value != "", func() { *opt = value })
+	}
+	mergeList := func(name, flagName string, opt *stringList, values []string) {
+		merge(name, flagName, len(values) > 0, func() { *opt = append(stringList{}, values...) })
+	}
+	mergeString("dirs", "terraform-dir", &opts.terraformDir, strings.Join(s.Dirs, "\n"))
+	mergeString("backend", "backend", &opts.backend, s.Backend)
+	mergeString("s3.bucket", "s3-bucket", &opts.s3Bucket, s.S3.Bucket)
+	mergeString("s3.keyPrefix", "s3-key-prefix", &opts.s3KeyPrefix, s.S3.KeyPrefix)
+	mergeString("s3.region", "s3-region", &opts.s3Region, s.S3.Region)
+	mergeString("s3.dynamodbTable", "s3-dynamodb-table", &opts.s3DynamoDBTable, s.S3.DynamoDBTable)
+	mergeString("stateNamespace", "state-namespace", &opts.stateNamespace, s.StateNamespace)
+	mergeString("secretsNamespace", "secrets-namespace", &opts.secretsNamespace, s.SecretsNamespace)
+	mergeString("stage", "stage", &opts.stage, s.Stage)
+	mergeString("workspace", "workspace", &opts.workspace, s.Workspace)
+	mergeString("planExtraArgs", "plan-extra-args", &opts.planExtraArgs, s.PlanExtraArgs)
+	mergeString("applyExtraArgs", "apply-extra-args", &opts.applyExtraArgs, s.ApplyExtraArgs)
+	mergeString("lockTimeout", "lock-timeout", &opts.lockTimeout, s.LockTimeout)
+	mergeString("approvalTimeout", "approval-timeout", &opts.approvalTimeout, s.ApprovalTimeout)
+	mergeString("outsideChangeWindow", "outside-change-window", &opts.outsideChangeWindow, s.OutsideChangeWindow)
+	mergeList("envSources", "env-sources", &opts.envSources, s.EnvSources)
+	mergeList("varFiles", "var-files", &opts.varFiles, s.VarFiles)
+	mergeList("vars", "vars", &opts.vars, s.Vars)
+	merge("parallelism", "parallelism", s.Parallelism > 0, func() { opts.parallelism = s.Parallelism })
+	tighten("planOnly", &opts.planOnly, s.PlanOnly)
+	tighten("requireApproval", &opts.requireApproval, s.RequireApproval)
+	tighten("guards.preventDestroy", &opts.preventDestroy, &s.Guards.PreventDestroy)
+	return merged
+}
+
+// loadODSConfig reads the terraform section of ods.yaml and resolves the
+// settings for the target environment (including its profile) into the
+// options before any other step uses them. Options given as flags take
+// precedence.
+func loadODSConfig() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		c, err := readODSTerraformConfig(d.opts.checkoutDir)
+		if err != nil {
+			return d, err
+		}
+		if c == nil {
+			d.logger.Debugf("No terraform section in ods.yaml.")
+			return d, nil
+		}
+		d.odsConfig = c
+		settings, profile, err := c.settingsFor(d.opts.targetEnvironment)
+		if err != nil {
+			return d, err
+		}
+		if profile != "" {
+			d.logger.Infof("Using profile %s for target environment %s.", profile, d.opts.targetEnvironment)
+		}
+		merged := settings.mergeInto(d.opts)
+		d.logger.Infof("Settings taken from terraform section of ods.yaml: [%s]", strings.Join(merged, ", "))
+		protected, err := c.isProtectedEnvironment(d.opts.targetEnvironment)
+		if err != nil {
+			return d, err
+		}
+		if protected {
+			d.logger.Infof("Target environment %s is protected.", d.opts.targetEnvironment)
+		}
+		d.changeWindows, err = parseChangeWindows(settings.ChangeWindows)
+		if err != nil {
+			return d, err
+		}
+		for _, w := range d.changeWindows {
+			d.logger.Infof("Changes to %s are applied only within change window %s of ods.yaml.", d.opts.targetEnvironment, w)
+		}
+		return d, nil
+	}
+}
+
+// planDestroyPattern matches the summary line of terraform plan, e.g.
+// "Plan: 1 to add, 0 to change, 2 to destroy.".
+var planDestroyPattern = regexp.MustCompile(`(?m)^Plan: .*?(\d+) to destroy`)
+
+// plannedDestroyCount returns the number of resources the plan output
+// destroys (including replacements).
+func plannedDestroyCount(planOutput []byte) int {
+	m := planDestroyPattern.FindSubmatch(planOutput)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(string(m[1]))
+	return n
+}
+
+// checkPolicies enforces the destroy guard and the policies of ods.yaml for
+// protected environments before applying changes.
+func checkPolicies() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		preventDestroy := d.opts.preventDestroy
+		if d.odsConfig != nil && d.odsConfig.Policies.PreventDestroy {
+			protected, err := d.odsConfig.isProtectedEnvironment(d.opts.targetEnvironment)
+			if err != nil {
+				return d, err
+			}
+			preventDestroy = preventDestroy || protected
+		}
+		if !preventDestroy {
+			return d, nil
+		}
+		violations := []string{}
+		for _, tfConfig := range d.tfConfigs {
+			if tfConfig.destroyCount > 0 {
+				violations = append(violations, fmt.Sprintf("%s destroys %d resources", tfConfig.terraformDir, tfConfig.destroyCount))
+			}
+		}
+		if len(violations) > 0 {
+			return d, fmt.Errorf("destroying resources is prevented in target environment %s: %s", d.opts.targetEnvironment, strings.Join(violations, "; "))
+		}
+		return d, nil
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const odsYAMLWithTerraform = `pipelines:
+- tasks:
+  - name: deploy
+terraform:
+  dirs:
+  - infra/*
+  backend: s3
+  s3:
+    bucket: tfstate
+  varFiles:
+  - common.tfvars
+  vars:
+  - size=small
+  planOnly: false
+  environments:
+    foo-prod:
+      s3:
+        bucket: tfstate-prod
+      varFiles:
+      - prod.tfvars
+      planOnly: true
+  protectedEnvironments:
+  - '*-prod'
+  policies:
+    preventDestroy: true
+`
+
+func TestReadODSTerraformConfig(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"ods.yaml": odsYAMLWithTerraform})
+	c, err := readODSTerraformConfig(dir)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	planOnly := true
+	want := odsTerraformSettings{
+		Dirs:     []string{"infra/*"},
+		Backend:  backendS3,
+		S3:       odsS3{Bucket: "tfstate-prod"},
+		VarFiles: []string{"common.tfvars", "prod.tfvars"},
+		Vars:     []string{"size=small"},
+		PlanOnly: &planOnly,
+	}
+	got, _, err := c.settingsFor("foo-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, cmpEmptyLists); diff != "" {
+		t.Fatalf("settings mismatch (-want +got):\n%s", diff)
+	}
+	if got, _, _ := c.settingsFor("foo-dev"); got.S3.Bucket != "tfstate" || *got.PlanOnly {
+		t.Fatalf("unexpected settings for foo-dev: %+v", got)
+	}
+	if !c.Policies.PreventDestroy {
+		t.Fatal("want policy preventDestroy")
+	}
+	for env, want := range map[string]bool{"foo-prod": true, "foo-dev": false} {
+		got, err := c.isProtectedEnvironment(env)
+		if err != nil || got != want {
+			t.Fatalf("isProtectedEnvironment(%s): want %v, got %v (err %v)", env, want, got, err)
+		}
+	}
+}
+
+var cmpEmptyLists = cmp.Transformer("emptyLists", func(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+})
+
+func TestSettingsForProfile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"ods.yaml": `terraform:
+  lockTimeout: 1m
+  varFiles: [common.tfvars]
+  profiles:
+  - name: dev
+    match: ['*-dev']
+    planOnly: false
+  - name: prod
+    match: ['*-prod', '*-prd']
+    planOnly: true
+    lockTimeout: 10m
+    parallelism: 2
+    varFiles: [prod.tfvars]
+    guards:
+      preventDestroy: true
+    changeWindows:
+    - days: [Mon-Fri]
+      start: "08:00"
+      end: "18:00"
+  - name: all-prod
+    match: ['*-prod']
+    planOnly: false
+  environments:
+    foo-prod:
+      parallelism: 5
+      changeWindows:
+      - days: [Tue, Thu]
+        start: "09:00"
+        end: "16:00"
+        timeZone: Europe/Berlin
+      outsideChangeWindow: plan-only
+`})
+	c, err := readODSTerraformConfig(dir)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	planOnly := true
+	tests := map[string]struct {
+		wantProfile  string
+		wantSettings odsTerraformSettings
+	}{
+		"foo-prod": {
+			wantProfile: "prod",
+			wantSettings: odsTerraformSettings{
+				LockTimeout: "10m",
+				Parallelism: 5,
+				VarFiles:    []string{"common.tfvars", "prod.tfvars"},
+				PlanOnly:    &planOnly,
+				Guards:      odsTerraformPolicies{PreventDestroy: true},
+				ChangeWindows: []odsChangeWindow{
+					{Days: []string{"Tue", "Thu"}, Start: "09:00", End: "16:00", TimeZone: "Europe/Berlin"},
+				},
+				OutsideChangeWindow: outsideChangeWindowPlanOnly,
+			},
+		},
+		"foo-test": {
+			wantSettings: odsTerraformSettings{
+				LockTimeout: "1m",
+				VarFiles:    []string{"common.tfvars"},
+			},
+		},
+	}
+	for env, tc := range tests {
+		t.Run(env, func(t *testing.T) {
+			got, profile, err := c.settingsFor(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile != tc.wantProfile {
+				t.Fatalf("want profile %q, got %q", tc.wantProfile, profile)
+			}
+			if diff := cmp.Diff(tc.wantSettings, got, cmpEmptyLists); diff != "" {
+				t.Fatalf("settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadODSTerraformConfigAbsent(t *testing.T) {
+	tests := map[string]map[string]string{
+		"no ods.yaml":          {},
+		"no terraform section": {"ods.yml": "pipelines: []\n"},
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := readODSTerraformConfig(writeFiles(t, files))
+			if err != nil || c != nil {
+				t.Fatalf("want nil config and no err, got %v, %v", c, err)
+			}
+		})
+	}
+}
+
+func TestReadODSTerraformConfigUnknownKey(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"ods.yaml": "terraform:\n  environments:\n    dev:\n      backnd: s3\n"})
+	_, err := readODSTerraformConfig(dir)
+	if err == nil || !strings.Contains(err.Error(), "backnd") {
+		t.Fatalf("want err about unknown key, got %v", err)
+	}
+}
+
+func TestReadODSTerraformConfigApplyRefs(t *testing.T) {
+	// The refs from which changes are applied must not be given by the
+	// repository they restrict.
+	dir := writeFiles(t, map[string]string{"ods.yaml": "terraform:\n  applyRefs: ['*']\n"})
+	_, err := readODSTerraformConfig(dir)
+	if err == nil || !strings.Contains(err.Error(), "applyRefs") {
+		t.Fatalf("want err about applyRefs, got %v", err)
+	}
+}
+
+func TestMergeInto(t *testing.T) {
+	planOnly := true
+	requireApproval := true
+	s := odsTerraformSettings{
+		Dirs:            []string{"infra/network", "infra/app"},
+		Backend:         backendS3,
+		S3:              odsS3{Bucket: "tfstate"},
+		VarFiles:        []string{"common.tfvars"},
+		Vars:            []string{"size=small"},
+		PlanExtraArgs:   "-parallelism=5",
+		PlanOnly:        &planOnly,
+		RequireApproval: &requireApproval,
+		Parallelism:     5,
+	}
+	opts := options{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addFlags(fs, &opts)
+	// Flags set to their default value take precedence as well, while flags
+	// with an empty value are not given. Safety settings of ods.yaml tighten
+	// the flags regardless.
+	err := parseFlags(fs, &opts, []string{
+		"-s3-bucket=from-flag",
+		"-vars=size=large",
+		"-plan-only=false",
+		"-parallelism=0",
+		"-backend=",
+		"-plan-extra-args=",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := s.mergeInto(&opts)
+
+	wantMerged := []string{"dirs", "backend", "planExtraArgs", "varFiles", "planOnly", "requireApproval"}
+	if diff := cmp.Diff(wantMerged, merged); diff != "" {
+		t.Fatalf("merged mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"infra/network", "infra/app"}, opts.terraformDirPatterns()); diff != "" {
+		t.Fatalf("dirs mismatch (-want +got):\n%s", diff)
+	}
+	if opts.backend != backendS3 || opts.s3Bucket != "from-flag" || !opts.planOnly || !opts.requireApproval || opts.parallelism != 0 {
+		t.Fatalf(
+			"unexpected options: backend %s, s3Bucket %s, planOnly %v, requireApproval %v, parallelism %d",
+			opts.backend, opts.s3Bucket, opts.planOnly, opts.requireApproval, opts.parallelism,
+		)
+	}
+	if diff := cmp.Diff(stringList{"size=large"}, opts.vars); diff != "" {
+		t.Fatalf("vars mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMergeIntoDoesNotLoosenSafetySettings(t *testing.T) {
+	planOnly := false
+	requireApproval := false
+	s := odsTerraformSettings{PlanOnly: &planOnly, RequireApproval: &requireApproval}
+	opts := options{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addFlags(fs, &opts)
+	err := parseFlags(fs, &opts, []string{"-plan-only=true", "-require-approval=true", "-prevent-destroy=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := s.mergeInto(&opts)
+	if len(merged) > 0 {
+		t.Fatalf("want nothing merged, got %v", merged)
+	}
+	if !opts.planOnly || !opts.requireApproval || !opts.preventDestroy {
+		t.Fatalf(
+			"want safety settings kept, got planOnly %v, requireApproval %v, preventDestroy %v",
+			opts.planOnly, opts.requireApproval, opts.preventDestroy,
+		)
+	}
+}
+
+func TestPlannedDestroyCount(t *testing.T) {
+	tests := map[string]struct {
+		output string
+		want   int
+	}{
+		"destroy": {
+			output: "  # null_resource.foo will be destroyed\n\nPlan: 1 to add, 0 to change, 2 to destroy.\n",
+			want:   2,
+		},
+		"import": {
+			output: "Plan: 1 to import, 0 to add, 0 to change, 3 to destroy.\n",
+			want:   3,
+		},
+		"no changes": {
+			output: "No changes. Your infrastructure matches the configuration.\n",
+			want:   0,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := plannedDestroyCount([]byte(tc.output)); got != tc.want {
+				t.Fatalf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	tests := map[string]struct {
+		targetEnvironment string
+		preventDestroy    bool
+		destroyCount      int
+		wantErr           bool
+	}{
+		"guard with destroy":        {targetEnvironment: "foo-dev", preventDestroy: true, destroyCount: 2, wantErr: true},
+		"protected with destroy":    {targetEnvironment: "foo-prod", destroyCount: 1, wantErr: true},
+		"protected without destroy": {targetEnvironment: "foo-prod", destroyCount: 0},
+		"unprotected with destroy":  {targetEnvironment: "foo-dev", destroyCount: 1},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := deployTerraformFromOptions(&options{targetEnvironment: tc.targetEnvironment, preventDestroy: tc.preventDestroy}, io.Discard, io.Discard)
+			d.odsConfig = &odsTerraformConfig{
+				ProtectedEnvironments: []string{"*-prod"},
+				Policies:              odsTerraformPolicies{PreventDestroy: true},
+			}
+			d.tfConfigs = []terraformConfig{{terraformDir: "terraform", destroyCount: tc.destroyCount}}
+			_, err := checkPolicies()(d)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+// planOnlyForRef returns whether a pipeline run for the git ref of ctxt only
+// plans, given the refs (full refs or patterns such as refs/tags/v*) from
+// which changes are applied, together with the reason. Refs are matched in
+// full, as a branch and a tag may have the same name: otherwise, anyone who
+// may push a branch named like a release tag could apply.
+func planOnlyForRef(ctxt *pipelinectxt.ODSContext, applyRefs []string) (bool, string, error) {
+	for _, ref := range applyRefs {
+		if !strings.HasPrefix(ref, "refs/") {
+			return false, "", fmt.Errorf("apply ref %s must be a full git ref such as refs/heads/main or refs/tags/v*", ref)
+		}
+	}
+	if ctxt.PullRequestKey != "" {
+		return true, fmt.Sprintf("pull request %s", ctxt.PullRequestKey), nil
+	}
+	if ctxt.GitFullRef == "" {
+		return true, "an unknown git ref", nil
+	}
+	ok, err := matchAny(applyRefs, ctxt.GitFullRef)
+	if err != nil {
+		return false, "", fmt.Errorf("apply refs: %w", err)
+	}
+	if ok {
+		return false, fmt.Sprintf("git ref %s matches apply refs", ctxt.GitFullRef), nil
+	}
+	return true, fmt.Sprintf("git ref %s does not match apply refs", ctxt.GitFullRef), nil
+}
+
+// selectPlanMode switches to plan-only mode if apply refs are configured and
+// the pipeline runs for a pull request or a git ref not matching them.
+// Plan-only mode requested explicitly is kept in any case.
+func selectPlanMode() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if len(d.opts.applyRefs) == 0 || d.opts.planOnly {
+			return d, nil
+		}
+		planOnly, reason, err := planOnlyForRef(d.ctxt, d.opts.applyRefs)
+		if err != nil {
+			return d, err
+		}
+		if planOnly {
+			d.logger.Infof("Only planning as the pipeline runs for %s.", reason)
+		} else {
+			d.logger.Infof("Applying changes as %s.", reason)
+		}
+		d.opts.planOnly = planOnly
+		return d, nil
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+func TestSelectPlanMode(t *testing.T) {
+	tests := map[string]struct {
+		ctxt         pipelinectxt.ODSContext
+		applyRefs    stringList
+		planOnly     bool
+		wantPlanOnly bool
+		wantErr      string
+	}{
+		"no apply refs": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/feature/foo", GitRef: "feature/foo"},
+			wantPlanOnly: false,
+		},
+		"main branch": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/main", GitRef: "main"},
+			applyRefs:    stringList{"refs/heads/main", "refs/tags/v*"},
+			wantPlanOnly: false,
+		},
+		"release tag": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/tags/v1.2.0", GitRef: "v1.2.0"},
+			applyRefs:    stringList{"refs/heads/main", "refs/tags/v*"},
+			wantPlanOnly: false,
+		},
+		"branch named like a release tag": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/v1.2", GitRef: "v1.2"},
+			applyRefs:    stringList{"refs/heads/main", "refs/tags/v*"},
+			wantPlanOnly: true,
+		},
+		"release branch pattern": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/release/1.2", GitRef: "release/1.2"},
+			applyRefs:    stringList{"refs/heads/release/*"},
+			wantPlanOnly: false,
+		},
+		"feature branch": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/feature/foo", GitRef: "feature/foo"},
+			applyRefs:    stringList{"refs/heads/main", "refs/tags/v*"},
+			wantPlanOnly: true,
+		},
+		"unknown git ref": {
+			ctxt:         pipelinectxt.ODSContext{GitRef: "main"},
+			applyRefs:    stringList{"refs/heads/main"},
+			wantPlanOnly: true,
+		},
+		"pull request": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/main", GitRef: "main", PullRequestKey: "42"},
+			applyRefs:    stringList{"refs/heads/main"},
+			wantPlanOnly: true,
+		},
+		"explicit plan-only": {
+			ctxt:         pipelinectxt.ODSContext{GitFullRef: "refs/heads/main", GitRef: "main"},
+			applyRefs:    stringList{"refs/heads/main"},
+			planOnly:     true,
+			wantPlanOnly: true,
+		},
+		"short ref": {
+			ctxt:      pipelinectxt.ODSContext{GitFullRef: "refs/tags/v1.2.0", GitRef: "v1.2.0"},
+			applyRefs: stringList{"refs/heads/main", "v*"},
+			wantErr:   "apply ref v* must be a full git ref such as refs/heads/main or refs/tags/v*",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := deployTerraformFromOptions(&options{applyRefs: tc.applyRefs, planOnly: tc.planOnly}, io.Discard, io.Discard)
+			ctxt := tc.ctxt
+			d.ctxt = &ctxt
+			_, err := selectPlanMode()(d)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if d.opts.planOnly != tc.wantPlanOnly {
+				t.Fatalf("want plan-only %v, got %v", tc.wantPlanOnly, d.opts.planOnly)
+			}
+		})
+	}
+}
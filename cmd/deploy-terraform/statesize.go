@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// stateSecretSizeLimit is the maximum size of a Kubernetes secret.
+	stateSecretSizeLimit = 1024 * 1024
+	// largestStateResourcesCount is the number of resources reported when
+	// the state size exceeds a threshold.
+	largestStateResourcesCount = 5
+)
+
+// resourceSize is the serialized size of a resource in the state.
+type resourceSize struct {
+	address string
+	size    int
+}
+
+func (r resourceSize) String() string {
+	return fmt.Sprintf("%s (%s)", r.address, formatBytes(r.size))
+}
+
+// stateSizeThresholds are percentages of stateSecretSizeLimit. As a flag,
+// they are given comma-separated and validated when the flag is parsed.
+type stateSizeThresholds []int
+
+func (t *stateSizeThresholds) String() string {
+	values := []string{}
+	for _, v := range *t {
+		values = append(values, strconv.Itoa(v))
+	}
+	return strings.Join(values, ",")
+}
+
+func (t *stateSizeThresholds) Set(value string) error {
+	thresholds, err := parseStateSizeThresholds(value)
+	if err != nil {
+		return err
+	}
+	*t = thresholds
+	return nil
+}
+
+// parseStateSizeThresholds parses comma-separated percentages of the secret
+// size limit.
+func parseStateSizeThresholds(value string) ([]int, error) {
+	thresholds := []int{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		t, err := strconv.Atoi(v)
+		if err != nil || t <= 0 || t > 100 {
+			return nil, fmt.Errorf("state size threshold '%s' must be a percentage between 1 and 100", v)
+		}
+		thresholds = append(thresholds, t)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+// exceededStateSizeThreshold returns the highest threshold (percentage of
+// stateSecretSizeLimit) reached by size, or 0 if none is reached.
+func exceededStateSizeThreshold(size int, thresholds []int) int {
+	exceeded := 0
+	for _, t := range thresholds {
+		if size*100 >= t*stateSecretSizeLimit {
+			exceeded = t
+		}
+	}
+	return exceeded
+}
+
+// largestStateResources returns the n largest resources of the gzipped
+// state by serialized size, largest first.
+func largestStateResources(gzipped []byte, n int) ([]resourceSize, error) {
+	r, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		return nil, fmt.Errorf("decompress state: %w", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress state: %w", err)
+	}
+	var state struct {
+		Resources []json.RawMessage `json:"resources"`
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("parse state: %w", err)
+	}
+	sizes := []resourceSize{}
+	for _, raw := range state.Resources {
+		var res struct {
+			Module string `json:"module"`
+			Mode   string `json:"mode"`
+			Type   string `json:"type"`
+			Name   string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &res); err != nil {
+			return nil, fmt.Errorf("parse state resource: %w", err)
+		}
+		address := fmt.Sprintf("%s.%s", res.Type, res.Name)
+		if res.Mode == "data" {
+			address = "data." + address
+		}
+		if res.Module != "" {
+			address = res.Module + "." + address
+		}
+		sizes = append(sizes, resourceSize{address: address, size: len(raw)})
+	}
+	sort.SliceStable(sizes, func(i, j int) bool { return sizes[i].size > sizes[j].size })
+	if len(sizes) > n {
+		sizes = sizes[:n]
+	}
+	return sizes, nil
+}
+
+// checkStateSize warns if the state secret with secretSuffix approaches the
+// size limit of Kubernetes secrets and returns its size. If the state secret
+// does not exist (yet), e.g. on the first deployment when nothing was
+// applied, found is false.
+func (d *deployTerraform) checkStateSize(secretSuffix string) (size int, found bool, err error) {
+	workspace := d.opts.workspace
+	if workspace == "" {
+		workspace = "default"
+	}
+	name := kubernetes.StateSecretName(workspace, secretSuffix)
+	secret, err := kubernetes.GetSecret(d.clientset, d.stateNamespace(), name)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			d.logger.Infof("State secret %s does not exist.", name)
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("get state secret %s: %w", name, err)
+	}
+	for _, v := range secret.Data {
+		size += len(v)
+	}
+	d.logger.Infof("State secret %s has a size of %s.", name, formatBytes(size))
+	threshold := exceededStateSizeThreshold(size, d.opts.stateSizeWarnThresholds)
+	if threshold == 0 {
+		return size, true, nil
+	}
+	d.logger.Warnf(
+		"State secret %s has a size of %s, which exceeds %d%% of the %s limit of Kubernetes secrets. Consider splitting the configuration.",
+		name, formatBytes(size), threshold, formatBytes(stateSecretSizeLimit),
+	)
+	largest, err := largestStateResources(secret.Data["tfstate"], largestStateResourcesCount)
+	if err != nil {
+		return size, true, err
+	}
+	resources := []string{}
+	for _, r := range largest {
+		resources = append(resources, r.String())
+	}
+	d.logger.Warnf("Largest resources in state (uncompressed): %s", strings.Join(resources, ", "))
+	return size, true, nil
+}
+
+// formatBytes formats size in bytes, KiB or MiB.
+func formatBytes(size int) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline/pkg/logging"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func gzipState(t *testing.T, state string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(state)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestLargestStateResources(t *testing.T) {
+	state := `{"version": 4, "resources": [
+{"mode": "managed", "type": "aws_s3_bucket", "name": "small", "instances": []},
+{"module": "module.network", "mode": "managed", "type": "aws_vpc", "name": "main", "instances": [{"attributes": {"cidr_block": "10.0.0.0/16", "tags": {"a": "b"}}}]},
+{"mode": "data", "type": "aws_iam_policy_document", "name": "doc", "instances": [{"attributes": {"json": "` + strings.Repeat("x", 200) + `"}}]}
+]}`
+	got, err := largestStateResources(gzipState(t, state), 2)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	gotAddresses := []string{}
+	for _, r := range got {
+		gotAddresses = append(gotAddresses, r.address)
+	}
+	want := []string{"data.aws_iam_policy_document.doc", "module.network.aws_vpc.main"}
+	if diff := cmp.Diff(want, gotAddresses); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExceededStateSizeThreshold(t *testing.T) {
+	thresholds, err := parseStateSizeThresholds("90, 75")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	tests := map[string]struct {
+		size int
+		want int
+	}{
+		"below":   {size: 700 * 1024, want: 0},
+		"warning": {size: 800 * 1024, want: 75},
+		"highest": {size: 1000 * 1024, want: 90},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := exceededStateSizeThreshold(tc.size, thresholds); got != tc.want {
+				t.Fatalf("want: %d, got: %d", tc.want, got)
+			}
+		})
+	}
+	if _, err := parseStateSizeThresholds("150"); err == nil {
+		t.Fatal("want err for threshold above 100, got none")
+	}
+}
+
+func TestCheckStateSize(t *testing.T) {
+	gzipped := gzipState(t, `{"version": 4, "resources": []}`)
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tfstate-default-foo-dev", Namespace: "foo-cd"},
+		Data:       map[string][]byte{"tfstate": gzipped},
+	})
+	result := filepath.Join(t.TempDir(), "state-size")
+	opts := &options{backend: backendKubernetes, stateSizeWarnThresholds: stateSizeThresholds{75, 90}, stateSizeResult: result}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+	d.clientset = clientset
+	d.tfConfigs = []terraformConfig{{terraformDir: "terraform", secretSuffix: "foo-dev"}}
+	noChanges := func(d *deployTerraform) (*deployTerraform, error) {
+		return d, &skipRemainingSteps{"No changes detected, skipping terraform apply."}
+	}
+	if err := d.runSteps(checkStateSize(), noChanges); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	got, err := os.ReadFile(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(gzipped); string(got) != strconv.Itoa(want) {
+		t.Fatalf("want state size %d, got %s", want, got)
+	}
+}
+
+func TestCheckStateSizeWithoutStateSecret(t *testing.T) {
+	result := filepath.Join(t.TempDir(), "state-size")
+	opts := &options{backend: backendKubernetes, stateSizeWarnThresholds: stateSizeThresholds{75, 90}, stateSizeResult: result}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	var stderr bytes.Buffer
+	d.logger = &logging.LeveledLogger{Level: logging.LevelInfo, StdoutOverride: io.Discard, StderrOverride: &stderr}
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+	d.clientset = fake.NewSimpleClientset()
+	d.tfConfigs = []terraformConfig{{terraformDir: "terraform", secretSuffix: "foo-dev"}}
+	if err := d.runSteps(checkStateSize()); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	got, err := os.ReadFile(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > 0 {
+		t.Fatalf("want empty state size, got %s", got)
+	}
+	if stderr.Len() > 0 {
+		t.Fatalf("want no warning, got %s", stderr.String())
+	}
+}
+
+func TestStateSizeThresholdsFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts := options{}
+	addFlags(fs, &opts)
+	if err := parseFlags(fs, &opts, nil); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if diff := cmp.Diff(stateSizeThresholds{75, 90}, opts.stateSizeWarnThresholds); diff != "" {
+		t.Fatalf("default mismatch (-want +got):\n%s", diff)
+	}
+	if err := parseFlags(fs, &opts, []string{"-state-size-warn-thresholds=95,50"}); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if diff := cmp.Diff(stateSizeThresholds{50, 95}, opts.stateSizeWarnThresholds); diff != "" {
+		t.Fatalf("thresholds mismatch (-want +got):\n%s", diff)
+	}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addFlags(fs, &opts)
+	if err := parseFlags(fs, &opts, []string{"-state-size-warn-thresholds=150"}); err == nil {
+		t.Fatal("want err for invalid threshold, got none")
+	}
+}
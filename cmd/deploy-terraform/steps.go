@@ -8,12 +8,16 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/opendevstack/ods-pipeline-terraform/internal/command"
+	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
+	"github.com/opendevstack/ods-pipeline-terraform/internal/vault"
 	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
-	"k8s.io/client-go/kubernetes"
+	k8s "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
@@ -25,6 +29,7 @@ type TerraformStep func(d *deployTerraform) (*deployTerraform, error)
 func (d *deployTerraform) runSteps(steps ...TerraformStep) error {
 	var skip *skipRemainingSteps
 	var err error
+	defer func() { d.cleanup() }()
 	for _, step := range steps {
 		d, err = step(d)
 		if err != nil {
@@ -37,6 +42,84 @@ func (d *deployTerraform) runSteps(steps ...TerraformStep) error {
 	}
 	return nil
 }
+
+// addCleanup registers f to be run once all steps are done, regardless of
+// whether they succeeded.
+func (d *deployTerraform) addCleanup(f func()) {
+	d.cleanupFuncs = append(d.cleanupFuncs, f)
+}
+
+// cleanup runs all registered cleanup functions in reverse order.
+func (d *deployTerraform) cleanup() {
+	for i := len(d.cleanupFuncs) - 1; i >= 0; i-- {
+		d.cleanupFuncs[i]()
+	}
+	d.cleanupFuncs = nil
+}
+
+// stateNamespace returns the namespace in which the state is stored.
+func (d *deployTerraform) stateNamespace() string {
+	if d.opts.stateNamespace != "" {
+		return d.opts.stateNamespace
+	}
+	return d.ctxt.Namespace
+}
+
+// secretsNamespace returns the namespace from which Secrets and ConfigMaps
+// are read.
+func (d *deployTerraform) secretsNamespace() string {
+	if d.opts.secretsNamespace != "" {
+		return d.opts.secretsNamespace
+	}
+	return d.ctxt.Namespace
+}
+
+// requiredAccess returns the permissions needed by the Kubernetes backend in
+// stateNamespace (unless empty), to read the given env sources from
+// secretsNamespace, to request approval in approvalNamespace (unless empty)
+// and to read (and create) the plan bundle key in planKeyNamespace (unless
+// empty). Terraform itself never deletes state secrets or leases (it unlocks
+// by updating the lease), so delete is only required to migrate state from
+// another suffix.
+func requiredAccess(stateNamespace, secretsNamespace, approvalNamespace, planKeyNamespace string, migrateState bool, sources []envSource) []kubernetes.Access {
+	accesses := []kubernetes.Access{}
+	if stateNamespace != "" {
+		secretVerbs := []string{"get", "list", "create", "update"}
+		leaseVerbs := []string{"get", "create", "update"}
+		if migrateState {
+			secretVerbs = append(secretVerbs, "delete")
+			leaseVerbs = append(leaseVerbs, "delete")
+		}
+		for _, verb := range secretVerbs {
+			accesses = append(accesses, kubernetes.Access{Namespace: stateNamespace, Verb: verb, Resource: "secrets"})
+		}
+		for _, verb := range leaseVerbs {
+			accesses = append(accesses, kubernetes.Access{Namespace: stateNamespace, Verb: verb, Group: "coordination.k8s.io", Resource: "leases"})
+		}
+	}
+	kinds := map[string]bool{}
+	for _, s := range sources {
+		kinds[s.kind] = true
+	}
+	if kinds[envSourceKindSecret] {
+		accesses = append(accesses, kubernetes.Access{Namespace: secretsNamespace, Verb: "get", Resource: "secrets"})
+	}
+	if kinds[envSourceKindConfigMap] {
+		accesses = append(accesses, kubernetes.Access{Namespace: secretsNamespace, Verb: "get", Resource: "configmaps"})
+	}
+	if approvalNamespace != "" {
+		for _, verb := range []string{"get", "create", "update", "delete"} {
+			accesses = append(accesses, kubernetes.Access{Namespace: approvalNamespace, Verb: verb, Resource: "configmaps"})
+		}
+	}
+	if planKeyNamespace != "" {
+		for _, verb := range []string{"get", "create"} {
+			accesses = append(accesses, kubernetes.Access{Namespace: planKeyNamespace, Verb: verb, Resource: "secrets"})
+		}
+	}
+	return accesses
+}
+
 func (d *deployTerraform) isVerbose() bool {
 	return d.opts.debug || d.opts.verbose
 }
@@ -50,11 +133,16 @@ func setupContext() TerraformStep {
 		}
 		d.ctxt = ctxt
 
-		clientset, err := newInClusterClientset()
+		clientset, configPath, configContext, err := newClientset(d.opts.kubeconfig, d.opts.kubeContext)
 		if err != nil {
 			return d, fmt.Errorf("create Kubernetes clientset: %w", err)
 		}
 		d.clientset = clientset
+		d.kubeconfigPath = configPath
+		d.kubeContext = configContext
+		if configPath != "" {
+			d.logger.Infof("Running outside of cluster using kubeconfig %s (context %s)", configPath, configContext)
+		}
 
 		if d.isVerbose() {
 			err = command.Run("sh", []string{
@@ -82,30 +170,344 @@ func setupContext() TerraformStep {
 	}
 }
 
-func renderBackend() TerraformStep {
+func setupStateSecret() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		labels, err := parseStateLabels(d.opts.stateLabels)
+		if err != nil {
+			return d, err
+		}
+		d.stateLabels = labels
+		configsBySuffix := map[string]string{}
+		for i, tfConfig := range d.tfConfigs {
+			suffix, err := d.stateSecretSuffix(d.stateSecretSuffixTemplate(tfConfig), tfConfig)
+			if err != nil {
+				return d, err
+			}
+			if other, ok := configsBySuffix[suffix]; ok {
+				return d, fmt.Errorf("terraform configs %s and %s would share state secret suffix %s", other, tfConfig.terraformDir, suffix)
+			}
+			configsBySuffix[suffix] = tfConfig.terraformDir
+			d.tfConfigs[i].secretSuffix = suffix
+			if tfConfig.subrepo == nil && d.opts.migrateStateFrom != "" {
+				current, err := d.stateSecretSuffixBeforeMigration(tfConfig, suffix)
+				if err != nil {
+					return d, err
+				}
+				if current != suffix {
+					d.tfConfigs[i].secretSuffix = current
+					d.tfConfigs[i].migrateToSuffix = suffix
+					d.logger.Infof("State of %s is migrated from suffix %s to %s once changes are applied", tfConfig.terraformDir, current, suffix)
+					continue
+				}
+			}
+			d.logger.Infof("State secret suffix of %s: %s", tfConfig.terraformDir, suffix)
+		}
+		kept := map[string]string{}
+		for i, tfConfig := range d.tfConfigs {
+			legacySuffix, err := d.legacyStateSecretSuffix(tfConfig, configsBySuffix)
+			if err != nil {
+				return d, err
+			}
+			if legacySuffix == "" {
+				continue
+			}
+			if other, ok := kept[legacySuffix]; ok {
+				return d, fmt.Errorf(
+					"state with the previous suffix %s exists, but neither %s nor %s has state of its own: run only the config it belongs to with migrate-state-from set to %s",
+					legacySuffix, other, tfConfig.terraformDir, defaultStateSecretSuffix,
+				)
+			}
+			kept[legacySuffix] = tfConfig.terraformDir
+			d.tfConfigs[i].secretSuffix = legacySuffix
+			d.logger.Infof(
+				"State of %s exists only with the previous suffix %s, which is kept. Set migrate-state-from to %s to move it to %s.",
+				tfConfig.terraformDir, legacySuffix, defaultStateSecretSuffix, tfConfig.secretSuffix,
+			)
+		}
+		return d, nil
+	}
+}
+
+// legacyStateSecretSuffix returns the suffix of the default template, which
+// previous versions of this task used for a config outside of the default
+// terraform directory, if tfConfig has no state under its own suffix but
+// under that one. Planning with the new suffix would recreate all resources,
+// so the previous suffix is kept until the state is moved via
+// migrate-state-from. An empty suffix is returned if state is migrated
+// anyway, the previous suffix belongs to another config or there is no
+// state under it.
+func (d *deployTerraform) legacyStateSecretSuffix(tfConfig terraformConfig, configsBySuffix map[string]string) (string, error) {
+	if d.opts.backend != backendKubernetes || d.opts.migrateStateFrom != "" || tfConfig.subrepo != nil ||
+		d.stateSecretSuffixTemplate(tfConfig) != defaultDirStateSecretSuffix {
+		return "", nil
+	}
+	legacySuffix, err := d.stateSecretSuffix(defaultStateSecretSuffix, tfConfig)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := configsBySuffix[legacySuffix]; ok {
+		return "", nil
+	}
+	namespace := d.stateNamespace()
+	current, err := kubernetes.ListStateSecrets(d.clientset, namespace, tfConfig.secretSuffix)
+	if err != nil {
+		return "", fmt.Errorf("list state secrets with suffix %s: %w", tfConfig.secretSuffix, err)
+	}
+	if len(current) > 0 {
+		return "", nil
+	}
+	legacy, err := kubernetes.ListStateSecrets(d.clientset, namespace, legacySuffix)
+	if err != nil {
+		return "", fmt.Errorf("list state secrets with suffix %s: %w", legacySuffix, err)
+	}
+	if len(legacy) == 0 {
+		return "", nil
+	}
+	return legacySuffix, nil
+}
+
+// stateSecretSuffixBeforeMigration returns the suffix of the state of
+// tfConfig stored under the suffix given by the migrate-state-from template,
+// which is moved to toSuffix only after the changes were applied (see
+// migrateStateSecrets). Until then, terraform plans and applies against the
+// state under the previous suffix. toSuffix is returned if there is no state
+// to move.
+func (d *deployTerraform) stateSecretSuffixBeforeMigration(tfConfig terraformConfig, toSuffix string) (string, error) {
+	fromSuffix, err := d.stateSecretSuffix(d.opts.migrateStateFrom, tfConfig)
+	if err != nil {
+		return "", err
+	}
+	if fromSuffix == toSuffix {
+		d.logger.Infof("State secret suffix unchanged: nothing to migrate")
+		return toSuffix, nil
+	}
+	namespace := d.stateNamespace()
+	from, err := kubernetes.ListStateSecrets(d.clientset, namespace, fromSuffix)
+	if err != nil {
+		return "", fmt.Errorf("list state secrets with suffix %s: %w", fromSuffix, err)
+	}
+	if len(from) == 0 {
+		d.logger.Infof("No state with suffix %s found: nothing to migrate", fromSuffix)
+		return toSuffix, nil
+	}
+	to, err := kubernetes.ListStateSecrets(d.clientset, namespace, toSuffix)
+	if err != nil {
+		return "", fmt.Errorf("list state secrets with suffix %s: %w", toSuffix, err)
+	}
+	if len(to) > 0 {
+		return "", fmt.Errorf("cannot migrate state from suffix %s to %s: state exists with both suffixes", fromSuffix, toSuffix)
+	}
+	return fromSuffix, nil
+}
+
+// migrateStateSecrets moves the state of each terraform config from the
+// previous suffix to the one it is migrated to, holding the state locks
+// while moving. Runs which only plan must not change the state, so they
+// leave it in place.
+func migrateStateSecrets() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		return d, d.migrateStateSecrets()
+	}
+}
+
+func (d *deployTerraform) migrateStateSecrets() error {
+	if d.opts.planOnly || d.opts.mode == modePlan {
+		return nil
+	}
+	holder := d.opts.build
+	if holder == "" {
+		holder = "deploy-terraform"
+	}
+	for i, tfConfig := range d.tfConfigs {
+		if tfConfig.migrateToSuffix == "" {
+			continue
+		}
+		moved, err := kubernetes.MoveStateSecrets(d.clientset, d.stateNamespace(), tfConfig.secretSuffix, tfConfig.migrateToSuffix, d.stateLabels, holder)
+		if err != nil {
+			return fmt.Errorf("migrate state from suffix %s: %w", tfConfig.secretSuffix, err)
+		}
+		d.logger.Infof("Migrated state from suffix %s to %s", tfConfig.secretSuffix, strings.Join(moved, ", "))
+		d.tfConfigs[i].secretSuffix = tfConfig.migrateToSuffix
+		d.tfConfigs[i].migrateToSuffix = ""
+	}
+	return nil
+}
+
+func checkPermissions() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
-		d.logger.Infof("rendering backend template %s...", d.opts.terraformDir)
-		err := d.renderBackend()
+		sources, err := d.envSources()
 		if err != nil {
-			return d, fmt.Errorf("render backend template failed: %w", err)
+			return d, err
+		}
+		stateNamespace := ""
+		if d.opts.backend == backendKubernetes {
+			stateNamespace = d.stateNamespace()
+		}
+		approvalNamespace := ""
+		if d.opts.requireApproval && !d.opts.planOnly {
+			approvalNamespace = d.ctxt.Namespace
+		}
+		planKeyNamespace := ""
+		if d.opts.mode != modePlanApply && !d.opts.planOnly {
+			planKeyNamespace = d.ctxt.Namespace
+		}
+		accesses := requiredAccess(stateNamespace, d.secretsNamespace(), approvalNamespace, planKeyNamespace, d.opts.migrateStateFrom != "", sources)
+		denied, err := kubernetes.DeniedAccess(d.clientset, accesses)
+		if err != nil {
+			d.logger.Warnf("Could not check permissions: %s", err)
+			return d, nil
+		}
+		if len(denied) > 0 {
+			missing := []string{}
+			for _, a := range denied {
+				missing = append(missing, a.String())
+			}
+			return d, fmt.Errorf("missing permissions: %s", strings.Join(missing, "; "))
 		}
+		d.logger.Infof("Permissions are sufficient.")
 		return d, nil
 	}
 }
 
 func setupEnvFromSecret() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
-		if d.opts.envFromSecret {
-			d.logger.Infof("deriving env variables from kubernetes secret")
-			envVars, err := d.terraformSecrets()
+		if !d.opts.envFromSecret {
+			d.logger.Infof("env-from-secret is false: skipping deriving env variables from kubernetes secret")
+		}
+		sources, err := d.envSources()
+		if err != nil {
+			return d, err
+		}
+		if len(sources) == 0 {
+			return d, nil
+		}
+		d.logger.Infof("deriving env variables from %s", sources)
+		result, err := loadEnvSources(sources, d.readEnvSource)
+		if err != nil {
+			return d, err
+		}
+		if len(result.conflicts) > 0 {
+			if d.opts.failOnEnvConflict {
+				return d, fmt.Errorf("conflicting env sources: %s", strings.Join(result.conflicts, "; "))
+			}
+			for _, c := range result.conflicts {
+				d.logger.Warnf("env source conflict: %s", c)
+			}
+		}
+		d.secretEnvVars = result.env
+		d.plainEnvKeys = result.plainKeys
+		d.logger.Infof("Secret env variables: [%s]", strings.Join(getKeys(result.env), ","))
+		return d, nil
+	}
+}
+
+// envSources returns the env sources to derive env variables from.
+func (d *deployTerraform) envSources() ([]envSource, error) {
+	sources := []envSource{}
+	if d.opts.envFromSecret {
+		sources = append(sources, envSource{
+			kind: envSourceKindSecret,
+			name: fmt.Sprintf("terraform-envs-%s", d.opts.targetEnvironment),
+		})
+	}
+	for _, es := range d.opts.envSources {
+		s, err := parseEnvSource(es)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// readEnvSource returns the data of Secrets and ConfigMaps in the secrets
+// namespace, and of secrets in Vault.
+func (d *deployTerraform) readEnvSource(s envSource) (map[string]string, error) {
+	if s.kind != envSourceKindVault {
+		return kubernetesEnvSourceReader(d.clientset, d.secretsNamespace())(s)
+	}
+	if d.opts.vaultAddr == "" {
+		return nil, fmt.Errorf("vault-addr must be set to use env source %s", s)
+	}
+	if d.vaultClient == nil {
+		d.vaultClient = vault.NewClient(d.opts.vaultAddr, d.opts.vaultAuthPath, d.opts.vaultRole, tokenFile)
+	}
+	return d.vaultClient.ReadKV(d.opts.vaultKVMount, s.name)
+}
+
+func setupWorkloadIdentity() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		w, err := selectWorkloadIdentity(d.opts.workloadIdentities, d.opts.targetEnvironment)
+		if err != nil {
+			return d, err
+		}
+		if w == nil {
+			return d, nil
+		}
+		d.logger.Infof("exchanging service account token for credentials of %s", w)
+		env, err := d.exchangeWorkloadIdentity(w, d.opts.workloadIdentityTokenFile)
+		if err != nil {
+			return d, fmt.Errorf("workload identity %s: %w", w, err)
+		}
+		if d.secretEnvVars == nil {
+			d.secretEnvVars = make(map[string]string)
+		}
+		if d.plainEnvKeys == nil {
+			d.plainEnvKeys = make(map[string]bool)
+		}
+		for k, v := range env {
+			if _, ok := d.secretEnvVars[k]; ok {
+				d.logger.Warnf("env variable %s from workload identity overrides env source", k)
+			}
+			d.secretEnvVars[k] = v
+			if plainWorkloadIdentityEnvKeys[k] {
+				d.plainEnvKeys[k] = true
+			} else {
+				delete(d.plainEnvKeys, k)
+			}
+		}
+		d.logger.Infof("Workload identity env variables: [%s]", strings.Join(getKeys(env), ","))
+		return d, nil
+	}
+}
+
+func setupEnvFiles() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if len(d.opts.envFiles) == 0 {
+			return d, nil
+		}
+		files := []envFile{}
+		for _, ef := range d.opts.envFiles {
+			f, err := parseEnvFile(ef)
 			if err != nil {
 				return d, err
 			}
-			d.secretEnvVars = envVars
-			d.logger.Infof("Secret env variables: [%s]", strings.Join(getKeys(envVars), ","))
-		} else {
-			d.logger.Infof("env-from-secret is %s: skipping deriving env variables from kubernetes secret")
+			files = append(files, f)
+		}
+		dir, err := os.MkdirTemp("", "terraform-env-files-")
+		if err != nil {
+			return d, fmt.Errorf("create env files dir: %w", err)
+		}
+		d.addCleanup(func() {
+			if err := os.RemoveAll(dir); err != nil {
+				d.logger.Warnf("remove env files dir %s: %s", dir, err)
+			}
+		})
+		if d.secretEnvVars == nil {
+			d.secretEnvVars = make(map[string]string)
+		}
+		paths, err := writeEnvFiles(dir, files, d.secretEnvVars)
+		if err != nil {
+			return d, err
+		}
+		if d.plainEnvKeys == nil {
+			d.plainEnvKeys = make(map[string]bool)
 		}
+		for name, path := range paths {
+			d.secretEnvVars[name] = path
+			d.plainEnvKeys[name] = true
+		}
+		d.logger.Infof("Env files: [%s]", strings.Join(getKeys(paths), ","))
 		return d, nil
 	}
 }
@@ -113,24 +515,75 @@ func setupEnvFromSecret() TerraformStep {
 func collectVarFiles() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
 		d.logger.Infof("Collecting Terraform .tfvar files ...")
-		d.varFiles = []string{}
-		varFilesCandidateNames := []string{
-			fmt.Sprintf("terraform.%s.tfvars", d.opts.targetEnvironment),
-			fmt.Sprintf("terraform.%s.tfvars.json", d.opts.targetEnvironment),
-		}
-		for _, vfcn := range varFilesCandidateNames {
-			vfc := filepath.Join(d.opts.terraformDir, vfcn)
-			if _, err := os.Stat(vfc); os.IsNotExist(err) {
-				d.logger.Infof("%s is not present, skipping.", vfc)
-			} else {
-				d.logger.Infof("%s is present, adding.", vfc)
-				d.varFiles = append(d.varFiles, vfcn)
+		stage := d.opts.stage
+		if stage == "" {
+			stage = stageFromEnvironment(d.opts.targetEnvironment)
+		}
+		candidates := varFileCandidates(stage, d.opts.targetEnvironment)
+		for i, tfConfig := range d.tfConfigs {
+			varFiles := d.existingVarFiles(tfConfig.terraformDir, candidates)
+			if tfConfig.subrepo != nil {
+				// Overrides provided by the umbrella repository for this subrepo
+				// in the same terraform dir. As terraform runs in the subrepo
+				// directory, these are passed as absolute paths.
+				overridesDir, err := filepath.Abs(filepath.Join(tfConfig.relDir, tfConfig.subrepo.Name()))
+				if err != nil {
+					return d, fmt.Errorf("resolve var file overrides dir for %s: %w", tfConfig.subrepo.Name(), err)
+				}
+				// Unlike in the subrepo directory, terraform does not load
+				// the common defaults in here by itself.
+				overrideCandidates := append(append([]string{}, commonVarFileCandidates...), candidates...)
+				for _, vf := range d.existingVarFiles(overridesDir, overrideCandidates) {
+					varFiles = append(varFiles, filepath.Join(overridesDir, vf))
+				}
+			}
+			for _, vf := range d.opts.varFiles {
+				if !strings.HasSuffix(vf, ".tfvars") && !strings.HasSuffix(vf, ".tfvars.json") {
+					return d, fmt.Errorf("var file %s must have extension .tfvars or .tfvars.json", vf)
+				}
+				if _, err := os.Stat(filepath.Join(tfConfig.terraformDir, vf)); err != nil {
+					return d, fmt.Errorf("var file %s not found in %s: %w", vf, tfConfig.terraformDir, err)
+				}
+				varFiles = append(varFiles, vf)
 			}
+			d.tfConfigs[i].varFiles = varFiles
+			d.logger.Infof("Var files for %s in order of precedence (lowest first): [%s]", tfConfig.terraformDir, strings.Join(varFiles, ", "))
 		}
 		return d, nil
 	}
 }
 
+func collectInputVars() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		inputVars, err := parseInputVars(d.opts.vars, d.secretEnvVars)
+		if err != nil {
+			return d, fmt.Errorf("parse vars: %w", err)
+		}
+		d.inputVars = inputVars
+		names := []string{}
+		for _, iv := range inputVars {
+			names = append(names, iv.name)
+		}
+		d.logger.Infof("Input variables: [%s]", strings.Join(names, ","))
+		return d, nil
+	}
+}
+
+// existingVarFiles returns those candidates which exist in dir.
+func (d *deployTerraform) existingVarFiles(dir string, candidates []string) []string {
+	varFiles := []string{}
+	for _, vfcn := range candidates {
+		vfc := filepath.Join(dir, vfcn)
+		if _, err := os.Stat(vfc); os.IsNotExist(err) {
+			d.logger.Debugf("%s is not present, skipping.", vfc)
+		} else {
+			d.logger.Infof("%s is present, adding.", vfc)
+			varFiles = append(varFiles, vfcn)
+		}
+	}
+	return varFiles
+}
+
 func getKeys(m map[string]string) []string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
@@ -142,7 +595,7 @@ func getKeys(m map[string]string) []string {
 func initTerraform() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
 		for _, tfConfig := range d.tfConfigs {
-			dir := tfConfig.terraformDir
+			dir := tfConfig.workDir
 			d.logger.Infof("terraform init %s...", dir)
 
 			initArgs, initEnv, sensitive, err := d.assembleInitWithK8sBackendArgsEnv()
@@ -154,6 +607,19 @@ func initTerraform() TerraformStep {
 			if err != nil {
 				return d, fmt.Errorf("terraform init: %w", err)
 			}
+
+			if d.opts.workspace != "" {
+				d.logger.Infof("terraform workspace select %s in %s...", d.opts.workspace, dir)
+				wsArgs, wsEnv, sensitive, err := d.assembleWorkspaceSelectArgsEnv(d.opts.workspace, true)
+				if err != nil {
+					return d, fmt.Errorf("assemble terraform workspace select args/env: %w", err)
+				}
+				printlnTerraformCmd(wsArgs, wsEnv, sensitive, dir, d.outWriter)
+				err = d.terraformCmd(wsArgs, wsEnv, dir, d.outWriter, d.errWriter)
+				if err != nil {
+					return d, fmt.Errorf("terraform workspace select: %w", err)
+				}
+			}
 		}
 		return d, nil
 	}
@@ -182,62 +648,141 @@ func detectDeploymentArtifacts() TerraformStep {
 	}
 }
 
-func (d *deployTerraform) isTerraformDir(dir string) bool {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		d.logger.Debugf("No terraform directory found at %s: %w", dir, err)
-		return false
-	}
-	// perhaps additional checks make sense to see whether dir is a terraform dir
-	return true
-}
-
 func locateTerraformConfigs() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
+		patterns := d.opts.terraformDirPatterns()
+		d.logger.Infof("Looking for terraform configs in [%s] ...", strings.Join(patterns, ", "))
+		candidates, err := discoverTerraformDirs("", ".", patterns)
+		if err != nil {
+			return d, err
+		}
 		tfConfigs := []terraformConfig{}
-		d.logger.Infof("Looking for terraform configs in directory '%s' ...", d.opts.terraformDir)
-		if d.isTerraformDir(d.opts.terraformDir) {
-			tfConfig := terraformConfig{
-				terraformDir: d.opts.terraformDir,
-				artifactName: artifactFilename("plan", d.opts.terraformDir, d.opts.targetEnvironment),
+		for _, c := range candidates {
+			if c.status != discoveryStatusConfig {
+				continue
 			}
-			tfConfigs = append(tfConfigs, tfConfig)
-			d.logger.Infof("Located %s ", tfConfig)
+			tfConfigs = append(tfConfigs, terraformConfig{
+				terraformDir: c.dir,
+				relDir:       c.relDir,
+				artifactName: artifactFilename("plan", c.relDir, d.opts.workspace, d.opts.targetEnvironment),
+			})
 		}
 
 		// Find terraform configs in subrepos
 		for _, r := range d.subrepos {
 			subrepo := filepath.Join(pipelinectxt.SubreposPath, r.Name())
-			subTerraformDir := filepath.Join(subrepo, d.opts.terraformDir)
-			if d.isTerraformDir(subTerraformDir) {
-				d.logger.Infof("No terraform config found at %s", subTerraformDir)
-				continue
+			subCandidates, err := discoverTerraformDirs(r.Name(), subrepo, patterns)
+			if err != nil {
+				return d, err
+			}
+			candidates = append(candidates, subCandidates...)
+			var deploymentArtifacts []string
+			for _, c := range subCandidates {
+				if c.status != discoveryStatusConfig {
+					continue
+				}
+				if deploymentArtifacts == nil {
+					deploymentArtifacts, err = pipelinectxt.ReadArtifactFilesIncludingSubrepos(pipelinectxt.DeploymentsPath, []fs.DirEntry{r})
+					if err != nil {
+						return d, fmt.Errorf("collect deployment artifacts: %w", err)
+					}
+				}
+				tfConfigs = append(tfConfigs, terraformConfig{
+					terraformDir:     c.dir,
+					relDir:           c.relDir,
+					artifactName:     artifactFilename("plan", c.relDir, d.opts.workspace, d.opts.targetEnvironment),
+					subrepo:          r,
+					subrepoArtifacts: deploymentArtifacts,
+				})
+			}
+		}
+		d.logger.Infof("Terraform config discovery:\n%s", discoveryTable(candidates))
+		configsByArtifact := map[string]string{}
+		for _, tfConfig := range tfConfigs {
+			artifact := tfConfig.artifactName
+			if tfConfig.subrepo != nil {
+				artifact = tfConfig.subrepo.Name() + "-" + artifact
 			}
-			d.logger.Infof("Located terraform config at %s directory", subTerraformDir)
-			deploymentArtifacts, err := pipelinectxt.ReadArtifactFilesIncludingSubrepos(pipelinectxt.DeploymentsPath, []fs.DirEntry{r})
+			if other, ok := configsByArtifact[artifact]; ok {
+				return d, fmt.Errorf("terraform configs %s and %s would share plan artifact %s", other, tfConfig.terraformDir, artifact)
+			}
+			configsByArtifact[artifact] = tfConfig.terraformDir
+		}
+		d.tfConfigs = tfConfigs
+		return d, nil
+	}
+}
+
+func prepareWorkDirs() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		for i, tfConfig := range d.tfConfigs {
+			workDir, err := d.prepareWorkDir(tfConfig)
 			if err != nil {
-				return d, fmt.Errorf("collect deployment artifacts: %w", err)
+				return d, err
 			}
-			tfConfig := terraformConfig{
-				terraformDir:     subTerraformDir,
-				artifactName:     artifactFilename("plan", d.opts.terraformDir, d.opts.targetEnvironment),
-				subrepo:          r,
-				subrepoArtifacts: deploymentArtifacts,
+			d.tfConfigs[i].workDir = workDir
+			d.logger.Infof("Running terraform for %s in scratch copy %s with %s backend", tfConfig.terraformDir, workDir, d.opts.backend)
+		}
+		return d, nil
+	}
+}
+
+func collectContextVars() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		for i, tfConfig := range d.tfConfigs {
+			declared, err := declaredVariables(tfConfig.terraformDir)
+			if err != nil {
+				return d, fmt.Errorf("detect declared variables: %w", err)
 			}
-			tfConfigs = append(tfConfigs, tfConfig)
-			d.logger.Infof("Located subrepo  %s ", tfConfig)
+			d.tfConfigs[i].contextVarsEnv = d.contextVarsEnv(declared)
+			d.logger.Infof("ODS context variables for %s: [%s]", tfConfig.terraformDir, strings.Join(getKeys(d.tfConfigs[i].contextVarsEnv), ","))
+		}
+		return d, nil
+	}
+}
 
+func checkRequiredVariables() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		problems := []string{}
+		for _, tfConfig := range d.tfConfigs {
+			missing, err := d.missingVariables(tfConfig)
+			if err != nil {
+				return d, fmt.Errorf("check required variables of %s: %w", tfConfig.terraformDir, err)
+			}
+			if len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: [%s]", tfConfig.terraformDir, strings.Join(missing, ", ")))
+			}
 		}
-		d.tfConfigs = tfConfigs
+		if len(problems) > 0 {
+			return d, fmt.Errorf("required variables without value: %s", strings.Join(problems, "; "))
+		}
+		for _, tfConfig := range d.tfConfigs {
+			overridden, err := d.overriddenSensitiveVariables(tfConfig)
+			if err != nil {
+				return d, fmt.Errorf("check input variables of %s: %w", tfConfig.terraformDir, err)
+			}
+			if len(overridden) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: [%s]", tfConfig.terraformDir, strings.Join(overridden, ", ")))
+			}
+		}
+		if len(problems) > 0 {
+			return d, fmt.Errorf(
+				"input variables taken from a secret are also set in var files, which take precedence: %s",
+				strings.Join(problems, "; "),
+			)
+		}
+		d.logger.Infof("All required variables are provided.")
 		return d, nil
 	}
 }
 
 func planTerraform() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
-		for _, tfConfig := range d.tfConfigs {
-			dir := tfConfig.terraformDir
-			d.logger.Infof("terraform plan %s...", dir)
-			planArgs, planEnv, sensitive, err := d.assemblePlanArgsEnv()
+		changed := 0
+		for i, tfConfig := range d.tfConfigs {
+			dir := tfConfig.workDir
+			d.logger.Infof("terraform plan %s...", tfConfig.terraformDir)
+			planArgs, planEnv, sensitive, err := d.assemblePlanArgsEnv(tfConfig)
 			if err != nil {
 				return d, fmt.Errorf("assemble terraform plan args: %w", err)
 			}
@@ -246,19 +791,28 @@ func planTerraform() TerraformStep {
 			planStdoutWriter := io.MultiWriter(d.outWriter, &planStdoutBuf)
 			inSync, err := d.terraformPlanInSync(planArgs, planEnv, dir, planStdoutWriter, d.errWriter)
 			if err != nil {
-				return d, fmt.Errorf("terraform plan: %w", err)
+				return d, fmt.Errorf("terraform plan %s: %w", tfConfig.terraformDir, err)
 			}
 			err = d.writeDeploymentArtifact(planStdoutBuf.Bytes(), tfConfig, d.opts.targetEnvironment)
 			if err != nil {
 				return d, fmt.Errorf("write plan artifact: %w", err)
 			}
-
-			if d.opts.planOnly {
-				return d, &skipRemainingSteps{"Only planning was requested, skipping terraform apply."}
+			d.tfConfigs[i].hasChanges = !inSync
+			d.tfConfigs[i].savedPlan = d.savesPlan()
+			d.tfConfigs[i].destroyCount = plannedDestroyCount(planStdoutBuf.Bytes())
+			d.tfConfigs[i].planSummary = planSummary(planStdoutBuf.Bytes())
+			if !inSync {
+				changed++
 			}
-			if inSync {
-				return d, &skipRemainingSteps{"No changes detected, skipping terraform apply."}
+		}
+		if d.opts.planOnly {
+			return d, &skipRemainingSteps{"Only planning was requested, skipping terraform apply."}
+		}
+		if changed == 0 && d.opts.mode != modePlan {
+			if err := d.migrateStateSecrets(); err != nil {
+				return d, err
 			}
+			return d, &skipRemainingSteps{"No changes detected, skipping terraform apply."}
 		}
 		return d, nil
 	}
@@ -266,23 +820,69 @@ func planTerraform() TerraformStep {
 
 func applyTerraform() TerraformStep {
 	return func(d *deployTerraform) (*deployTerraform, error) {
+		if err := d.checkChangeWindow(d.now()); err != nil {
+			return d, err
+		}
 		for _, tfConfig := range d.tfConfigs {
-			dir := tfConfig.terraformDir
-			d.logger.Infof("terraform plan to %s...", dir)
-			applyArgs, applyEnv, sensitive, err := d.assembleApplyArgsEnv()
+			if !tfConfig.hasChanges {
+				d.logger.Infof("No changes detected in %s, skipping terraform apply.", tfConfig.terraformDir)
+				continue
+			}
+			dir := tfConfig.workDir
+			d.logger.Infof("terraform apply %s...", tfConfig.terraformDir)
+			applyArgs, applyEnv, sensitive, err := d.assembleApplyArgsEnv(tfConfig)
 			if err != nil {
 				return d, fmt.Errorf("assemble terraform apply args: %w", err)
 			}
 			printlnTerraformCmd(applyArgs, applyEnv, sensitive, dir, d.outWriter)
 			err = d.terraformCmd(applyArgs, applyEnv, dir, d.outWriter, d.errWriter)
 			if err != nil {
-				return d, fmt.Errorf("terraform apply: %w", err)
+				return d, fmt.Errorf("terraform apply %s: %w", tfConfig.terraformDir, err)
 			}
 		}
 		return d, nil
 	}
 }
 
+// checkStateSize registers a check of the size of the state secrets which
+// runs once all steps are done, so that the state size result is written
+// also if no changes were applied and the remaining steps were skipped.
+func checkStateSize() TerraformStep {
+	return func(d *deployTerraform) (*deployTerraform, error) {
+		if d.opts.backend != backendKubernetes {
+			return d, nil
+		}
+		d.addCleanup(d.reportStateSize)
+		return d, nil
+	}
+}
+
+// reportStateSize checks the size of the state secret of each terraform
+// config and writes the largest size to the state size result. If no state
+// secret exists, the result is empty rather than 0.
+func (d *deployTerraform) reportStateSize() {
+	largest := -1
+	for _, tfConfig := range d.tfConfigs {
+		size, found, err := d.checkStateSize(tfConfig.secretSuffix)
+		if err != nil {
+			d.logger.Warnf("Could not check state size of %s: %s", tfConfig.terraformDir, err)
+			continue
+		}
+		if found && size > largest {
+			largest = size
+		}
+	}
+	if d.opts.stateSizeResult != "" {
+		result := ""
+		if largest >= 0 {
+			result = strconv.Itoa(largest)
+		}
+		if err := os.WriteFile(d.opts.stateSizeResult, []byte(result), 0644); err != nil {
+			d.logger.Warnf("Could not write state size result: %s", err)
+		}
+	}
+}
+
 func (d *deployTerraform) writeDeploymentArtifact(content []byte, tfConfig terraformConfig, targetEnv string) error {
 	var f string
 	if tfConfig.subrepo != nil {
@@ -298,20 +898,58 @@ func (d *deployTerraform) writeDeploymentArtifact(content []byte, tfConfig terra
 	return err
 }
 
-func artifactFilename(filename, terraformDir, targetEnv string) string {
+func artifactFilename(filename, terraformDir, workspace, targetEnv string) string {
 	trimmedTerraformDir := strings.TrimPrefix(terraformDir, "./")
 	if trimmedTerraformDir != "terraform" {
 		filename = fmt.Sprintf("%s-%s", strings.Replace(trimmedTerraformDir, "/", "-", -1), filename)
 	}
+	if workspace != "" && workspace != "default" {
+		filename = fmt.Sprintf("%s-%s", filename, workspace)
+	}
 	return fmt.Sprintf("%s-%s", filename, targetEnv)
 }
 
-func newInClusterClientset() (*kubernetes.Clientset, error) {
-	// creates the in-cluster config
-	config, err := rest.InClusterConfig()
+// newClientset creates a clientset from the in-cluster config. If kubeconfig
+// or kubeContext is given, or if not running in a cluster, the standard
+// kubeconfig loading rules apply instead and the kubeconfig file and context
+// used are returned as well.
+func newClientset(kubeconfig, kubeContext string) (clientset *k8s.Clientset, configPath, configContext string, err error) {
+	if kubeconfig == "" && kubeContext == "" {
+		// creates the in-cluster config
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			clientset, err = k8s.NewForConfig(config)
+			return clientset, "", "", err
+		}
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return nil, "", "", err
+		}
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	)
+	rawConfig, err := clientConfig.RawConfig()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("load kubeconfig: %w", err)
+	}
+	configContext = kubeContext
+	if configContext == "" {
+		configContext = rawConfig.CurrentContext
+	}
+	configPath = kubeconfig
+	if configPath == "" {
+		configPath = loadingRules.GetDefaultFilename()
+	}
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		return nil, "", "", err
+	}
+	config, err := clientConfig.ClientConfig()
 	if err != nil {
-		return nil, err
+		return nil, "", "", fmt.Errorf("load kubeconfig: %w", err)
 	}
-	// creates the clientset
-	return kubernetes.NewForConfig(config)
+	clientset, err = k8s.NewForConfig(config)
+	return clientset, configPath, configContext, err
 }
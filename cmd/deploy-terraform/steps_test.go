@@ -1,13 +1,25 @@
 package main
 
 import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestArtifactFilename(t *testing.T) {
 	tests := map[string]struct {
 		filename     string
 		terraformDir string
+		workspace    string
 		targetEnv    string
 		want         string
 	}{
@@ -41,14 +53,304 @@ func TestArtifactFilename(t *testing.T) {
 			targetEnv:    "prod",
 			want:         "some-path-terraform-plan-prod",
 		},
+		"default workspace": {
+			filename:     "plan",
+			terraformDir: "./terraform",
+			workspace:    "default",
+			targetEnv:    "dev",
+			want:         "plan-dev",
+		},
+		"other workspace": {
+			filename:     "plan",
+			terraformDir: "./terraform",
+			workspace:    "feature-foo",
+			targetEnv:    "dev",
+			want:         "plan-feature-foo-dev",
+		},
+		"other workspace and terraform dir": {
+			filename:     "plan",
+			terraformDir: "./infra",
+			workspace:    "feature-foo",
+			targetEnv:    "dev",
+			want:         "infra-plan-feature-foo-dev",
+		},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			got := artifactFilename(tc.filename, tc.terraformDir, tc.targetEnv)
+			got := artifactFilename(tc.filename, tc.terraformDir, tc.workspace, tc.targetEnv)
 			if got != tc.want {
 				t.Fatalf("want: %s, got: %s", tc.want, got)
 			}
 		})
 	}
 }
+
+func TestCollectVarFilesKeepsAutoTfvarsPrecedence(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.tf":              `variable "region" {}`,
+		"terraform.tfvars":     `region = "common"`,
+		"foo.auto.tfvars":      `region = "auto"`,
+		"terraform.dev.tfvars": `other = "dev"`,
+	})
+	opts := &options{targetEnvironment: "dev"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.tfConfigs = []terraformConfig{{terraformDir: dir}}
+	d, err := collectVarFiles()(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Terraform loads terraform.tfvars, then *.auto.tfvars and then each
+	// -var-file in the given order, later files overriding earlier ones.
+	loaded := []string{"terraform.tfvars", "foo.auto.tfvars"}
+	for _, arg := range d.commonTerraformPlanApplyArgs(d.tfConfigs[0]) {
+		if vf, ok := strings.CutPrefix(arg, "-var-file="); ok {
+			loaded = append(loaded, vf)
+		}
+	}
+	setBy := ""
+	for _, vf := range loaded {
+		assigned, err := assignedVariables(filepath.Join(dir, vf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range assigned {
+			if v == "region" {
+				setBy = vf
+			}
+		}
+	}
+	if setBy != "foo.auto.tfvars" {
+		t.Fatalf("want region set by foo.auto.tfvars, got %s (loaded in order: %v)", setBy, loaded)
+	}
+}
+
+func TestCollectVarFiles(t *testing.T) {
+	wsDir := t.TempDir()
+	files := []string{
+		"terraform/terraform.tfvars",
+		"terraform/terraform.dev.tfvars",
+		"terraform/terraform.foo-dev.tfvars.json",
+		"terraform/terraform.foo-qa.tfvars",
+		"terraform/sub/terraform.foo-dev.tfvars",
+		"repos/sub/terraform/terraform.tfvars",
+		"repos/sub/terraform/terraform.foo-dev.tfvars",
+		"terraform/sub/terraform.tfvars",
+	}
+	for _, f := range files {
+		path := filepath.Join(wsDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subrepos, err := os.ReadDir(filepath.Join(wsDir, "repos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, wsDir)
+	opts := &options{terraformDir: "terraform", targetEnvironment: "foo-dev"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.tfConfigs = []terraformConfig{
+		{terraformDir: filepath.Join(wsDir, "terraform"), relDir: "terraform"},
+		{terraformDir: filepath.Join(wsDir, "repos/sub/terraform"), relDir: "terraform", subrepo: subrepos[0]},
+	}
+	d, err = collectVarFiles()(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"terraform.dev.tfvars", "terraform.foo-dev.tfvars.json"},
+		{
+			"terraform.foo-dev.tfvars",
+			filepath.Join(wsDir, "terraform/sub/terraform.tfvars"),
+			filepath.Join(wsDir, "terraform/sub/terraform.foo-dev.tfvars"),
+		},
+	}
+	for i, tfConfig := range d.tfConfigs {
+		if diff := cmp.Diff(want[i], tfConfig.varFiles); diff != "" {
+			t.Fatalf("var files of %s mismatch (-want +got):\n%s", tfConfig.terraformDir, diff)
+		}
+	}
+
+	t.Run("additional var files", func(t *testing.T) {
+		d.tfConfigs = d.tfConfigs[:1]
+		d.opts.varFiles = []string{"terraform.foo-qa.tfvars"}
+		d, err = collectVarFiles()(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"terraform.dev.tfvars", "terraform.foo-dev.tfvars.json", "terraform.foo-qa.tfvars"}
+		if diff := cmp.Diff(want, d.tfConfigs[0].varFiles); diff != "" {
+			t.Fatalf("var files mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing additional var file", func(t *testing.T) {
+		d.opts.varFiles = []string{"missing.tfvars"}
+		_, err = collectVarFiles()(d)
+		if err == nil {
+			t.Fatal("want err, got none")
+		}
+	})
+
+	t.Run("additional var file with wrong extension", func(t *testing.T) {
+		d.opts.varFiles = []string{"main.tf"}
+		_, err = collectVarFiles()(d)
+		if err == nil {
+			t.Fatal("want err, got none")
+		}
+	})
+}
+
+func TestCheckPermissions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = attrs.Namespace == "foo-cd" || attrs.Resource == "secrets"
+		return true, review, nil
+	})
+	tests := map[string]struct {
+		stateNamespace   string
+		migrateStateFrom string
+		envSources       []string
+		wantErr          string
+	}{
+		"pipeline namespace": {
+			envSources: []string{"configmap:settings"},
+		},
+		"state namespace without lease permissions": {
+			stateNamespace: "foo-prod",
+			wantErr:        "missing permissions: get leases.coordination.k8s.io in namespace foo-prod; create leases.coordination.k8s.io in namespace foo-prod; update leases.coordination.k8s.io in namespace foo-prod",
+		},
+		"state namespace without lease permissions when migrating state": {
+			stateNamespace:   "foo-prod",
+			migrateStateFrom: "{{.Component}}-{{.Environment}}",
+			wantErr:          "missing permissions: get leases.coordination.k8s.io in namespace foo-prod; create leases.coordination.k8s.io in namespace foo-prod; update leases.coordination.k8s.io in namespace foo-prod; delete leases.coordination.k8s.io in namespace foo-prod",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := &options{targetEnvironment: "dev", backend: backendKubernetes, envFromSecret: true, envSources: tc.envSources, stateNamespace: tc.stateNamespace, migrateStateFrom: tc.migrateStateFrom}
+			d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+			d.clientset = clientset
+			_, err := checkPermissions()(d)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("want no err, got %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPlanApplyTerraform(t *testing.T) {
+	wsDir := t.TempDir()
+	chdir(t, wsDir)
+	if err := os.MkdirAll(pipelinectxt.DeploymentsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The fake terraform reports changes for configs containing a file
+	// called changes.
+	bin := filepath.Join(t.TempDir(), "terraform")
+	script := "#!/bin/sh\necho \"$1 $(basename $PWD)\" >> " + filepath.Join(wsDir, "log") + "\n" +
+		"if [ \"$1\" = plan ] && [ -f changes ]; then exit 2; fi\n"
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	tfConfigs := []terraformConfig{}
+	for _, name := range []string{"network", "db", "app"} {
+		dir := filepath.Join(wsDir, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if name != "db" {
+			if err := os.WriteFile(filepath.Join(dir, "changes"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tfConfigs = append(tfConfigs, terraformConfig{terraformDir: name, workDir: dir, artifactName: name + "-plan-dev"})
+	}
+	d := deployTerraformFromOptions(&options{targetEnvironment: "dev"}, io.Discard, io.Discard)
+	d.terraformBin = bin
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+	d.tfConfigs = tfConfigs
+	if err := d.runSteps(planTerraform(), applyTerraform()); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	calls, err := os.ReadFile(filepath.Join(wsDir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"plan network", "plan db", "plan app", "apply network", "apply app"}
+	if diff := cmp.Diff(want, strings.Split(strings.TrimSpace(string(calls)), "\n")); diff != "" {
+		t.Fatalf("calls mismatch (-want +got):\n%s", diff)
+	}
+	for _, name := range []string{"network", "db", "app"} {
+		if _, err := os.Stat(filepath.Join(pipelinectxt.DeploymentsPath, name+"-plan-dev.txt")); err != nil {
+			t.Fatalf("want plan artifact for %s, got %s", name, err)
+		}
+	}
+}
+
+func TestPlanApplyTerraformAppliesSavedPlan(t *testing.T) {
+	wsDir := t.TempDir()
+	chdir(t, wsDir)
+	if err := os.MkdirAll(pipelinectxt.DeploymentsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(wsDir, "log")
+	bin := filepath.Join(t.TempDir(), "terraform")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n" +
+		"if [ \"$1\" = plan ]; then exit 2; fi\n"
+	if err := os.WriteFile(bin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{targetEnvironment: "dev", requireApproval: true}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.terraformBin = bin
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+	d.inputVars = []inputVar{{name: "size", value: "small"}}
+	d.tfConfigs = []terraformConfig{{terraformDir: "terraform", workDir: t.TempDir(), artifactName: "plan-dev"}}
+	if err := d.runSteps(planTerraform(), applyTerraform()); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	calls, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"plan -detailed-exitcode -input=false -no-color -compact-warnings -var=size=small -out=tfplan",
+		"apply -auto-approve -input=false -no-color -compact-warnings tfplan",
+	}
+	if diff := cmp.Diff(want, strings.Split(strings.TrimSpace(string(calls)), "\n")); diff != "" {
+		t.Fatalf("calls mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPlanTerraformWithoutChangesInModePlan(t *testing.T) {
+	chdir(t, t.TempDir())
+	if err := os.MkdirAll(pipelinectxt.DeploymentsPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(t.TempDir(), "terraform")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\nexit 0\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	d := deployTerraformFromOptions(&options{targetEnvironment: "dev", mode: modePlan}, io.Discard, io.Discard)
+	d.terraformBin = bin
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+	d.tfConfigs = []terraformConfig{{terraformDir: "terraform", workDir: t.TempDir(), artifactName: "plan-dev"}}
+	// The plan bundles step records that there are no changes.
+	if _, err := planTerraform()(d); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 
 	"github.com/google/shlex"
 	"github.com/opendevstack/ods-pipeline-terraform/internal/command"
-	"github.com/opendevstack/ods-pipeline-terraform/internal/kubernetes"
 	"github.com/opendevstack/ods-pipeline-terraform/internal/output"
 )
 
@@ -34,23 +33,94 @@ func (d *deployTerraform) terraformPlanInSync(args []string, env map[string]stri
 	)
 }
 
+// assembleInitWithK8sBackendArgsEnv creates a slice of arguments for
+// "terraform init". In mode apply-plan, the dependency lock file restored
+// from the plan bundle must not be changed.
 func (d *deployTerraform) assembleInitWithK8sBackendArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
 	args = []string{
 		"init",
 	}
-	commonArgs := d.commonTerraformArgs()
+	args = append(args, d.commonTerraformArgs()...)
+	if d.opts.mode == modeApplyPlan {
+		args = append(args, "-lockfile=readonly")
+	}
 	env = d.commonTerraformEnv()
 	env["TF_PLUGIN_CACHE_DIR"] = d.pluginCacheDir
-	sensitive = []string{}
-	for k, v := range d.secretEnvVars {
-		env[k] = v
-		sensitive = append(sensitive, v)
+	sensitive = d.addSecretEnv(env)
+	return args, env, sensitive, nil
+}
+
+// assembleMigrateStateArgsEnv creates a slice of arguments for
+// "terraform init", copying existing state to the configured backend
+// without asking for confirmation.
+func (d *deployTerraform) assembleMigrateStateArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+	args, env, sensitive, err = d.assembleInitWithK8sBackendArgsEnv()
+	if err != nil {
+		return args, env, sensitive, err
 	}
-	return append(args, commonArgs...), env, sensitive, nil
+	return append(args, "-migrate-state", "-force-copy"), env, sensitive, nil
+}
+
+// assembleReconfigureArgsEnv creates a slice of arguments for
+// "terraform init", switching to the configured backend without migrating
+// any state.
+func (d *deployTerraform) assembleReconfigureArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+	args, env, sensitive, err = d.assembleInitWithK8sBackendArgsEnv()
+	if err != nil {
+		return args, env, sensitive, err
+	}
+	return append(args, "-reconfigure"), env, sensitive, nil
+}
+
+// assembleWorkspaceListArgsEnv creates a slice of arguments for
+// "terraform workspace list".
+func (d *deployTerraform) assembleWorkspaceListArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+	args = []string{"workspace", "list", "-no-color"}
+	env = d.commonTerraformEnv()
+	sensitive = d.addSecretEnv(env)
+	return args, env, sensitive, nil
+}
+
+// assembleStateListArgsEnv creates a slice of arguments for
+// "terraform state list".
+func (d *deployTerraform) assembleStateListArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+	args = []string{
+		"state",
+		"list",
+	}
+	env = d.commonTerraformEnv()
+	sensitive = d.addSecretEnv(env)
+	return args, env, sensitive, nil
+}
+
+// assembleStatePullArgsEnv creates a slice of arguments for
+// "terraform state pull".
+func (d *deployTerraform) assembleStatePullArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+	args = []string{
+		"state",
+		"pull",
+	}
+	env = d.commonTerraformEnv()
+	sensitive = d.addSecretEnv(env)
+	return args, env, sensitive, nil
+}
+
+// assembleWorkspaceSelectArgsEnv creates a slice of arguments for
+// "terraform workspace select". If create is set, the workspace is created
+// if it does not exist.
+func (d *deployTerraform) assembleWorkspaceSelectArgsEnv(workspace string, create bool) (args []string, env map[string]string, sensitive []string, err error) {
+	args = []string{"workspace", "select"}
+	if create {
+		args = append(args, "-or-create")
+	}
+	args = append(args, "-no-color", workspace)
+	env = d.commonTerraformEnv()
+	sensitive = d.addSecretEnv(env)
+	return args, env, sensitive, nil
 }
 
 // assemblePlanArgs creates a slice of arguments for "terraform plan".
-func (d *deployTerraform) assemblePlanArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+func (d *deployTerraform) assemblePlanArgsEnv(tfConfig terraformConfig) (args []string, env map[string]string, sensitive []string, err error) {
 	empty := []string{}
 	emptyEnv := make(map[string]string)
 	args = []string{
@@ -61,59 +131,112 @@ func (d *deployTerraform) assemblePlanArgsEnv() (args []string, env map[string]s
 	if err != nil {
 		return empty, emptyEnv, empty, fmt.Errorf("parse plan-extra-args (%s): %s", d.opts.planExtraArgs, err)
 	}
-	commonArgs := d.commonTerraformPlanApplyArgs()
+	commonArgs := d.commonTerraformPlanApplyArgs(tfConfig)
 	args = append(args, commonArgs...)
+	if d.savesPlan() {
+		args = append(args, fmt.Sprintf("-out=%s", planFile))
+	}
 	args = append(args, planExtraArgs...)
 
-	env = d.commonTerraformPlanApplyEnv()
-	sensitive = []string{}
-	for k, v := range d.secretEnvVars {
-		env[k] = v
-		sensitive = append(sensitive, v)
-	}
+	env = d.commonTerraformPlanApplyEnv(tfConfig)
+	sensitive = append(d.sensitiveInputVarValues(), d.addSecretEnv(env)...)
+	d.addSensitiveInputVarEnv(tfConfig, env)
 	return args, env, sensitive, nil
 }
 
+// savesPlan returns whether terraform plan saves the plan, which is then
+// applied as is: in mode plan to apply it in a later task run, and if approval
+// is required so that exactly the approved plan is applied.
+func (d *deployTerraform) savesPlan() bool {
+	return d.opts.mode == modePlan || d.opts.requireApproval
+}
+
 // assembleApplyArgs creates a slice of arguments for "terraform apply".
-func (d *deployTerraform) assembleApplyArgsEnv() (args []string, env map[string]string, sensitive []string, err error) {
+func (d *deployTerraform) assembleApplyArgsEnv(tfConfig terraformConfig) (args []string, env map[string]string, sensitive []string, err error) {
 	empty := []string{}
 	emptyEnv := make(map[string]string)
 	args = []string{
 		"apply",
-		"-auto-approve", // should save plan instead and use it
+		"-auto-approve",
 	}
 	applyExtraArgs, err := shlex.Split(d.opts.applyExtraArgs)
 	if err != nil {
 		return empty, emptyEnv, empty, fmt.Errorf("parse apply-extra-args (%s): %s", d.opts.applyExtraArgs, err)
 	}
-	commonArgs := d.commonTerraformPlanApplyArgs()
+	commonArgs := d.commonTerraformPlanApplyArgs(tfConfig)
 	args = append(args, commonArgs...)
 	args = append(args, applyExtraArgs...)
-	env = d.commonTerraformPlanApplyEnv()
-	sensitive = []string{}
-	for k, v := range d.secretEnvVars {
-		env[k] = v
-		sensitive = append(sensitive, v)
+	if tfConfig.savedPlan {
+		args = append(args, planFile)
 	}
+	env = d.commonTerraformPlanApplyEnv(tfConfig)
+	sensitive = append(d.sensitiveInputVarValues(), d.addSecretEnv(env)...)
+	d.addSensitiveInputVarEnv(tfConfig, env)
 	return args, env, sensitive, nil
 }
 
 // commonTerraformPlanApplyArgs returns arguments common to "terraform upgrade" and "terraform diff upgrade".
-func (d *deployTerraform) commonTerraformPlanApplyArgs() []string {
+func (d *deployTerraform) commonTerraformPlanApplyArgs(tfConfig terraformConfig) []string {
 	args := d.commonTerraformArgs()
 	apArgs := []string{
 		"-compact-warnings",
 	}
 	args = append(args, apArgs...)
-	for _, vf := range d.varFiles {
+	if d.opts.lockTimeout != "" {
+		args = append(args, fmt.Sprintf("-lock-timeout=%s", d.opts.lockTimeout))
+	}
+	if d.opts.parallelism > 0 {
+		args = append(args, fmt.Sprintf("-parallelism=%d", d.opts.parallelism))
+	}
+	if tfConfig.savedPlan {
+		// Variables are part of the saved plan.
+		return args
+	}
+	for _, vf := range tfConfig.varFiles {
 		args = append(args, fmt.Sprintf("-var-file=%s", vf))
 	}
+	for _, iv := range d.inputVars {
+		if iv.sensitive {
+			// Passed via env, see addSensitiveInputVarEnv.
+			continue
+		}
+		args = append(args, fmt.Sprintf("-var=%s=%s", iv.name, iv.value))
+	}
 	return args
 }
 
-func (d *deployTerraform) commonTerraformPlanApplyEnv() map[string]string {
-	args := d.commonTerraformEnv()
-	return args
+// addSensitiveInputVarEnv adds the input variables taken from a secret to env
+// as TF_VAR_<name>, so that their values do not show up in the process
+// arguments. They override env variables of the same name from env sources.
+func (d *deployTerraform) addSensitiveInputVarEnv(tfConfig terraformConfig, env map[string]string) {
+	if tfConfig.savedPlan {
+		// Variables are part of the saved plan.
+		return
+	}
+	for _, iv := range d.inputVars {
+		if iv.sensitive {
+			env["TF_VAR_"+iv.name] = iv.value
+		}
+	}
+}
+
+// sensitiveInputVarValues returns the values of input variables taken from a secret.
+func (d *deployTerraform) sensitiveInputVarValues() []string {
+	sensitive := []string{}
+	for _, iv := range d.inputVars {
+		if iv.sensitive {
+			sensitive = append(sensitive, iv.value)
+		}
+	}
+	return sensitive
+}
+
+func (d *deployTerraform) commonTerraformPlanApplyEnv(tfConfig terraformConfig) map[string]string {
+	env := d.commonTerraformEnv()
+	for k, v := range tfConfig.contextVarsEnv {
+		env[k] = v
+	}
+	return env
 }
 
 // commonTerraformArgs returns arguments common to any Terraform command.
@@ -132,17 +255,21 @@ func (d *deployTerraform) commonTerraformArgs() []string {
 
 func (d *deployTerraform) commonTerraformEnv() map[string]string {
 	envs := make(map[string]string)
-	envs["KUBE_NAMESPACE"] = d.ctxt.Namespace
+	envs["KUBE_NAMESPACE"] = d.stateNamespace()
 	return envs
 }
 
-func (d *deployTerraform) terraformSecrets() (map[string]string, error) {
-	d.secretName = fmt.Sprintf("terraform-envs-%s", d.opts.targetEnvironment)
-	envs, err := kubernetes.GetSecrets(d.clientset, d.ctxt.Namespace, d.secretName)
-	if err != nil {
-		return nil, fmt.Errorf("getting secret '%s' in namespace %s failed: %w)", d.secretName, d.ctxt.Namespace, err)
+// addSecretEnv adds the env variables derived from env sources to env and
+// returns the values which need to be masked in output.
+func (d *deployTerraform) addSecretEnv(env map[string]string) []string {
+	sensitive := []string{}
+	for k, v := range d.secretEnvVars {
+		env[k] = v
+		if !d.plainEnvKeys[k] {
+			sensitive = append(sensitive, v)
+		}
 	}
-	return envs, nil
+	return sensitive
 }
 
 func getCwd() string {
@@ -40,6 +40,20 @@ func TestInitArgEnvs(t *testing.T) {
 			},
 			wantSensitive: []string{},
 		},
+		"init args/env in mode apply-plan": {
+			opts: options{
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				mode:              modeApplyPlan,
+			},
+			ctxtNamespace:  "namespace",
+			pluginCacheDir: "../../test/pluginCache",
+			wantArgs:       []string{"init", "-input=false", "-no-color", "-lockfile=readonly"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+			},
+			wantSensitive: []string{},
+		},
 	}
 
 	for name, tc := range tests {
@@ -80,13 +94,15 @@ func TestInitArgEnvs(t *testing.T) {
 
 func TestPlanArgEnvs(t *testing.T) {
 	tests := map[string]struct {
-		opts          options
-		ctxtNamespace string
-		varFiles      []string
-		wantErr       bool
-		wantArgs      []string
-		wantEnv       map[string]string
-		wantSensitive []string
+		opts           options
+		ctxtNamespace  string
+		varFiles       []string
+		contextVarsEnv map[string]string
+		inputVars      []inputVar
+		wantErr        bool
+		wantArgs       []string
+		wantEnv        map[string]string
+		wantSensitive  []string
 	}{
 		"plan args/env default": {
 			opts: options{
@@ -106,6 +122,51 @@ func TestPlanArgEnvs(t *testing.T) {
 			},
 			wantSensitive: []string{},
 		},
+		"plan args/env with lock timeout and parallelism": {
+			opts: options{
+				checkoutDir:       "../../test/testdata/workspaces/terraform-sample",
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				lockTimeout:       "5m",
+				parallelism:       3,
+			},
+			ctxtNamespace: "namespace",
+			wantErr:       false,
+			wantArgs:      []string{"plan", "-detailed-exitcode", "-input=false", "-no-color", "-compact-warnings", "-lock-timeout=5m", "-parallelism=3"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+			},
+			wantSensitive: []string{},
+		},
+		"plan args/env in mode plan": {
+			opts: options{
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				mode:              modePlan,
+			},
+			ctxtNamespace: "namespace",
+			wantErr:       false,
+			wantArgs:      []string{"plan", "-detailed-exitcode", "-input=false", "-no-color", "-compact-warnings", "-out=tfplan"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+			},
+			wantSensitive: []string{},
+		},
+		"plan args/env requiring approval": {
+			opts: options{
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				mode:              modePlanApply,
+				requireApproval:   true,
+			},
+			ctxtNamespace: "namespace",
+			wantErr:       false,
+			wantArgs:      []string{"plan", "-detailed-exitcode", "-input=false", "-no-color", "-compact-warnings", "-out=tfplan"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+			},
+			wantSensitive: []string{},
+		},
 		"plan args/env with tfvar file": {
 			opts: options{
 				checkoutDir:       "../../test/testdata/workspaces/terraform-sample",
@@ -150,6 +211,46 @@ func TestPlanArgEnvs(t *testing.T) {
 			},
 			wantSensitive: []string{},
 		},
+		"plan args/env with ODS context variables": {
+			opts: options{
+				checkoutDir:       "../../test/testdata/workspaces/terraform-sample",
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+			},
+			ctxtNamespace:  "namespace",
+			contextVarsEnv: map[string]string{"TF_VAR_ods_component": "foo"},
+			wantErr:        false,
+			wantArgs:       []string{"plan", "-detailed-exitcode", "-input=false", "-no-color", "-compact-warnings"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE":       "namespace",
+				"TF_VAR_ods_component": "foo",
+			},
+			wantSensitive: []string{},
+		},
+		"plan args/env with input variables": {
+			opts: options{
+				checkoutDir:       "../../test/testdata/workspaces/terraform-sample",
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+			},
+			ctxtNamespace: "namespace",
+			varFiles:      []string{"terraform.dev.tfvars", "extra.tfvars"},
+			inputVars: []inputVar{
+				{name: "region", value: "eu-west-1"},
+				{name: "db_password", value: "s3cr3t", sensitive: true},
+			},
+			wantErr: false,
+			wantArgs: []string{
+				"plan", "-detailed-exitcode", "-input=false", "-no-color", "-compact-warnings",
+				"-var-file=terraform.dev.tfvars", "-var-file=extra.tfvars",
+				"-var=region=eu-west-1",
+			},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE":     "namespace",
+				"TF_VAR_db_password": "s3cr3t",
+			},
+			wantSensitive: []string{"s3cr3t"},
+		},
 	}
 
 	for name, tc := range tests {
@@ -161,9 +262,10 @@ func TestPlanArgEnvs(t *testing.T) {
 			d.ctxt = &pipelinectxt.ODSContext{
 				Namespace: tc.ctxtNamespace,
 			}
-			d.varFiles = tc.varFiles
 
-			args, env, sensitive, err := d.assemblePlanArgsEnv()
+			d.inputVars = tc.inputVars
+
+			args, env, sensitive, err := d.assemblePlanArgsEnv(terraformConfig{varFiles: tc.varFiles, contextVarsEnv: tc.contextVarsEnv})
 			if tc.wantErr && err == nil {
 				t.Fatal("want err, got none")
 			}
@@ -188,11 +290,27 @@ func TestApplyArgEnvs(t *testing.T) {
 		opts          options
 		ctxtNamespace string
 		varFiles      []string
+		savedPlan     bool
 		wantErr       bool
 		wantArgs      []string
 		wantEnv       map[string]string
 		wantSensitive []string
 	}{
+		"apply args/env with saved plan": {
+			opts: options{
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				mode:              modeApplyPlan,
+			},
+			ctxtNamespace: "namespace",
+			varFiles:      []string{"terraform.dev.tfvars"},
+			savedPlan:     true,
+			wantArgs:      []string{"apply", "-auto-approve", "-input=false", "-no-color", "-compact-warnings", "tfplan"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+			},
+			wantSensitive: []string{},
+		},
 		"apply args/env default": {
 			opts: options{
 				checkoutDir:       "../../test/testdata/workspaces/terraform-sample",
@@ -266,9 +384,8 @@ func TestApplyArgEnvs(t *testing.T) {
 			d.ctxt = &pipelinectxt.ODSContext{
 				Namespace: tc.ctxtNamespace,
 			}
-			d.varFiles = tc.varFiles
 
-			args, env, sensitive, err := d.assembleApplyArgsEnv()
+			args, env, sensitive, err := d.assembleApplyArgsEnv(terraformConfig{varFiles: tc.varFiles, savedPlan: tc.savedPlan})
 			if tc.wantErr && err == nil {
 				t.Fatal("want err, got none")
 			}
@@ -287,3 +404,91 @@ func TestApplyArgEnvs(t *testing.T) {
 		})
 	}
 }
+
+func TestWorkspaceSelectArgEnvs(t *testing.T) {
+	tests := map[string]struct {
+		opts          options
+		create        bool
+		ctxtNamespace string
+		secretEnvVars map[string]string
+		wantArgs      []string
+		wantEnv       map[string]string
+		wantSensitive []string
+	}{
+		"workspace select args/env": {
+			opts: options{
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				workspace:         "feature-foo",
+			},
+			create:        true,
+			ctxtNamespace: "namespace",
+			wantArgs:      []string{"workspace", "select", "-or-create", "-no-color", "feature-foo"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+			},
+			wantSensitive: []string{},
+		},
+		"workspace select args/env with secret env without creating": {
+			opts: options{
+				terraformDir:      "../../test/testdata/workspaces/terraform-sample",
+				targetEnvironment: "dev",
+				workspace:         "feature-foo",
+			},
+			ctxtNamespace: "namespace",
+			secretEnvVars: map[string]string{"TF_VAR_token": "s3cr3t"},
+			wantArgs:      []string{"workspace", "select", "-no-color", "feature-foo"},
+			wantEnv: map[string]string{
+				"KUBE_NAMESPACE": "namespace",
+				"TF_VAR_token":   "s3cr3t",
+			},
+			wantSensitive: []string{"s3cr3t"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := deployTerraformFromOptions(&tc.opts, io.Discard, io.Discard)
+			d.ctxt = &pipelinectxt.ODSContext{
+				Namespace: tc.ctxtNamespace,
+			}
+			d.secretEnvVars = tc.secretEnvVars
+
+			args, env, sensitive, err := d.assembleWorkspaceSelectArgsEnv(tc.opts.workspace, tc.create)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.wantArgs, args); diff != "" {
+				t.Fatalf("args mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantEnv, env); diff != "" {
+				t.Fatalf("env mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantSensitive, sensitive); diff != "" {
+				t.Fatalf("sensitive mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAddSecretEnv(t *testing.T) {
+	d := deployTerraformFromOptions(&options{}, io.Discard, io.Discard)
+	d.secretEnvVars = map[string]string{
+		"ARM_CLIENT_SECRET": "s3cr3t",
+		"TF_VAR_size":       "small",
+	}
+	d.plainEnvKeys = map[string]bool{"TF_VAR_size": true}
+	env := map[string]string{"KUBE_NAMESPACE": "namespace"}
+	sensitive := d.addSecretEnv(env)
+	wantEnv := map[string]string{
+		"KUBE_NAMESPACE":    "namespace",
+		"ARM_CLIENT_SECRET": "s3cr3t",
+		"TF_VAR_size":       "small",
+	}
+	if diff := cmp.Diff(wantEnv, env); diff != "" {
+		t.Fatalf("env mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"s3cr3t"}, sensitive); diff != "" {
+		t.Fatalf("sensitive mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/shlex"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+)
+
+// secretVarValuePrefix marks an input variable value referencing a key of
+// the env secret.
+const secretVarValuePrefix = "secret:"
+
+// variableNamePattern matches valid Terraform identifiers.
+var variableNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+
+// variableSchema selects the variable blocks of a configuration file.
+var variableSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+}
+
+// variableDefaultSchema selects the default attribute of a variable block.
+var variableDefaultSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{{Name: "default"}},
+}
+
+// variableDeclaration describes an input variable declared by a configuration.
+type variableDeclaration struct {
+	hasDefault bool
+}
+
+// parseHCLFile parses the given HCL file, or its JSON variant if the name
+// ends in .json, the same way Terraform does.
+func parseHCLFile(parser *hclparse.Parser, name string, content []byte) (*hcl.File, error) {
+	var f *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(name, ".json") {
+		f, diags = parser.ParseJSON(content, name)
+	} else {
+		f, diags = parser.ParseHCL(content, name)
+	}
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("parse %s: %w", name, diags)
+	}
+	return f, nil
+}
+
+// declaredVariables returns all input variables declared in the *.tf and
+// *.tf.json files located directly in dir, keyed by name.
+func declaredVariables(dir string) (map[string]variableDeclaration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir %s: %w", dir, err)
+	}
+	parser := hclparse.NewParser()
+	declared := make(map[string]variableDeclaration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if !strings.HasSuffix(name, ".tf") && !strings.HasSuffix(name, ".tf.json") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		f, err := parseHCLFile(parser, name, content)
+		if err != nil {
+			return nil, err
+		}
+		// Other blocks and attributes are of no interest here.
+		body, _, diags := f.Body.PartialContent(variableSchema)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("parse %s: %w", name, diags)
+		}
+		for _, block := range body.Blocks {
+			attrs, _, diags := block.Body.PartialContent(variableDefaultSchema)
+			if diags.HasErrors() {
+				return nil, fmt.Errorf("parse %s: %w", name, diags)
+			}
+			_, hasDefault := attrs.Attributes["default"]
+			declared[block.Labels[0]] = variableDeclaration{hasDefault: hasDefault}
+		}
+	}
+	return declared, nil
+}
+
+// assignedVariables returns the names of the variables assigned in the
+// given .tfvars or .tfvars.json file.
+func assignedVariables(file string) ([]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", file, err)
+	}
+	f, err := parseHCLFile(hclparse.NewParser(), file, content)
+	if err != nil {
+		return nil, err
+	}
+	attrs, diags := f.Body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("parse %s: %w", file, diags)
+	}
+	assigned := []string{}
+	for name := range attrs {
+		assigned = append(assigned, name)
+	}
+	return assigned, nil
+}
+
+// autoLoadedVarFilePatterns are the var files terraform loads automatically.
+var autoLoadedVarFilePatterns = []string{
+	"terraform.tfvars", "terraform.tfvars.json", "*.auto.tfvars", "*.auto.tfvars.json",
+}
+
+// loadedVarFiles returns the var files terraform loads for tfConfig: the ones
+// it loads automatically, the collected ones and the ones given via
+// -var-file in plan-extra-args. The names of the variables given via -var in
+// plan-extra-args are returned as well.
+func (d *deployTerraform) loadedVarFiles(tfConfig terraformConfig) (varFiles []string, extraVars []string, err error) {
+	for _, pattern := range autoLoadedVarFilePatterns {
+		matches, err := filepath.Glob(filepath.Join(tfConfig.terraformDir, pattern))
+		if err != nil {
+			return nil, nil, err
+		}
+		varFiles = append(varFiles, matches...)
+	}
+	extraArgs, err := shlex.Split(d.opts.planExtraArgs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse plan-extra-args (%s): %s", d.opts.planExtraArgs, err)
+	}
+	for _, vf := range tfConfig.varFiles {
+		varFiles = append(varFiles, resolveInDir(tfConfig.terraformDir, vf))
+	}
+	for i, arg := range extraArgs {
+		name, value := flagNameValue(extraArgs, i, arg)
+		switch name {
+		case "var-file":
+			varFiles = append(varFiles, resolveInDir(tfConfig.terraformDir, value))
+		case "var":
+			if v, _, found := strings.Cut(value, "="); found {
+				extraVars = append(extraVars, v)
+			}
+		}
+	}
+	return varFiles, extraVars, nil
+}
+
+// missingVariables returns the sorted names of the variables declared by
+// tfConfig without a default which are neither set by a var file, a TF_VAR_*
+// env variable nor a -var argument.
+func (d *deployTerraform) missingVariables(tfConfig terraformConfig) ([]string, error) {
+	declared, err := declaredVariables(tfConfig.terraformDir)
+	if err != nil {
+		return nil, err
+	}
+	provided := make(map[string]bool)
+
+	varFiles, extraVars, err := d.loadedVarFiles(tfConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range extraVars {
+		provided[v] = true
+	}
+	for _, vf := range varFiles {
+		assigned, err := assignedVariables(vf)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range assigned {
+			provided[v] = true
+		}
+	}
+
+	envs := []map[string]string{d.secretEnvVars, tfConfig.contextVarsEnv}
+	osEnv := make(map[string]string)
+	for _, e := range os.Environ() {
+		if k, v, found := strings.Cut(e, "="); found {
+			osEnv[k] = v
+		}
+	}
+	envs = append(envs, osEnv)
+	for _, env := range envs {
+		for k := range env {
+			if strings.HasPrefix(k, "TF_VAR_") {
+				provided[strings.TrimPrefix(k, "TF_VAR_")] = true
+			}
+		}
+	}
+	for _, iv := range d.inputVars {
+		provided[iv.name] = true
+	}
+
+	missing := []string{}
+	for name, decl := range declared {
+		if !decl.hasDefault && !provided[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// overriddenSensitiveVariables returns the input variables taken from a
+// secret which are also assigned in a var file loaded for tfConfig, each
+// together with the var file. As they are passed as TF_VAR_<name>, which
+// terraform ranks below var files, the value of the var file would silently
+// take precedence.
+func (d *deployTerraform) overriddenSensitiveVariables(tfConfig terraformConfig) ([]string, error) {
+	sensitive := map[string]bool{}
+	for _, iv := range d.inputVars {
+		if iv.sensitive {
+			sensitive[iv.name] = true
+		}
+	}
+	if len(sensitive) == 0 {
+		return nil, nil
+	}
+	varFiles, _, err := d.loadedVarFiles(tfConfig)
+	if err != nil {
+		return nil, err
+	}
+	overridden := []string{}
+	for _, vf := range varFiles {
+		assigned, err := assignedVariables(vf)
+		if err != nil {
+			return nil, err
+		}
+		name := vf
+		if rel, err := filepath.Rel(tfConfig.terraformDir, vf); err == nil {
+			name = rel
+		}
+		for _, v := range assigned {
+			if sensitive[v] {
+				overridden = append(overridden, fmt.Sprintf("%s (%s)", v, name))
+			}
+		}
+	}
+	sort.Strings(overridden)
+	return overridden, nil
+}
+
+// flagNameValue returns the name and value of the flag at index i of args,
+// supporting both -name=value and -name value forms.
+func flagNameValue(args []string, i int, arg string) (name, value string) {
+	if !strings.HasPrefix(arg, "-") {
+		return "", ""
+	}
+	name, value, found := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	if !found && i+1 < len(args) {
+		value = args[i+1]
+	}
+	return name, value
+}
+
+// resolveInDir returns path relative to dir unless it is absolute.
+func resolveInDir(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// inputVar is an input variable passed to terraform via -var, or via env
+// variable TF_VAR_<name> if it is sensitive.
+type inputVar struct {
+	name  string
+	value string
+	// sensitive is true if the value is taken from a secret.
+	sensitive bool
+}
+
+// parseInputVars parses name=value pairs into input variables. Values of the
+// form secret:KEY are looked up in secretEnvVars.
+func parseInputVars(vars []string, secretEnvVars map[string]string) ([]inputVar, error) {
+	inputVars := []inputVar{}
+	for _, v := range vars {
+		name, value, found := strings.Cut(v, "=")
+		if !found {
+			return nil, fmt.Errorf("variable '%s' is not of the form name=value", v)
+		}
+		name = strings.TrimSpace(name)
+		if !variableNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("variable name '%s' is not a valid identifier", name)
+		}
+		iv := inputVar{name: name, value: value}
+		if strings.HasPrefix(value, secretVarValuePrefix) {
+			key := strings.TrimPrefix(value, secretVarValuePrefix)
+			secretValue, ok := secretEnvVars[key]
+			if !ok {
+				return nil, fmt.Errorf("variable '%s' references key '%s' which is not present in the env secret", name, key)
+			}
+			iv.value = secretValue
+			iv.sensitive = true
+		}
+		inputVars = append(inputVars, iv)
+	}
+	return inputVars, nil
+}
+
+// stageFromEnvironment derives the stage (dev, qa or prod) from the target
+// environment, which is either named like the stage or suffixed with it
+// (e.g. "foo-qa"). An empty string is returned if no stage can be derived.
+func stageFromEnvironment(env string) string {
+	for _, stage := range []string{"dev", "qa", "prod"} {
+		if env == stage || strings.HasSuffix(env, "-"+stage) {
+			return stage
+		}
+	}
+	return ""
+}
+
+// commonVarFileCandidates are the names of the .tfvars files with common
+// defaults for all environments. Terraform loads them by itself from the
+// directory it runs in (before *.auto.tfvars), so they are only passed
+// explicitly for directories terraform does not load them from.
+var commonVarFileCandidates = []string{"terraform.tfvars", "terraform.tfvars.json"}
+
+// varFileCandidates returns the names of .tfvars files to look for, in order
+// of increasing precedence: stage-level and environment specific files. The
+// environment is more specific than its stage, so its values win.
+func varFileCandidates(stage, env string) []string {
+	bases := []string{}
+	if stage != "" && stage != env {
+		bases = append(bases, fmt.Sprintf("terraform.%s", stage))
+	}
+	bases = append(bases, fmt.Sprintf("terraform.%s", env))
+	candidates := []string{}
+	for _, b := range bases {
+		candidates = append(candidates, b+".tfvars", b+".tfvars.json")
+	}
+	return candidates
+}
+
+// odsContextVariables returns the ODS pipeline context as Terraform input
+// variables (ods_*), keyed by variable name.
+func (d *deployTerraform) odsContextVariables() map[string]string {
+	return map[string]string{
+		"ods_project":            d.ctxt.Project,
+		"ods_component":          d.ctxt.Component,
+		"ods_repository":         d.ctxt.Repository,
+		"ods_git_commit_sha":     d.ctxt.GitCommitSHA,
+		"ods_git_ref":            d.ctxt.GitRef,
+		"ods_namespace":          d.ctxt.Namespace,
+		"ods_target_environment": d.opts.targetEnvironment,
+		"ods_build":              d.opts.build,
+	}
+}
+
+// contextVarsEnv returns TF_VAR_ods_* env variables for those ODS context
+// variables which are declared in the given set of variables.
+func (d *deployTerraform) contextVarsEnv(declared map[string]variableDeclaration) map[string]string {
+	env := make(map[string]string)
+	for name, value := range d.odsContextVariables() {
+		if _, ok := declared[name]; ok {
+			env["TF_VAR_"+name] = value
+		}
+	}
+	return env
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+func TestDeclaredVariables(t *testing.T) {
+	tests := map[string]struct {
+		files map[string]string
+		want  map[string]variableDeclaration
+	}{
+		"tf files": {
+			files: map[string]string{
+				"variables.tf": `variable "hello" {
+  type = string
+}
+
+variable "ods_component" {}
+
+variable "region" {
+  type    = string
+  default = "eu-west-1"
+}
+
+variable "inline" { default = 1 }
+
+variable "object_type" {
+  type = object({ default = string })
+}
+
+variable "inline_object_type" { type = object({ default = string }) }
+
+variable "nested" {
+  type = object({
+    default = string
+  })
+  validation {
+    condition     = length(var.nested.default) > 0
+    error_message = "Must not be empty { default = x }."
+  }
+}
+`,
+				"main.tf": "resource \"foo\" \"bar\" {\n  name = var.hello\n}\n",
+			},
+			want: map[string]variableDeclaration{
+				"hello":              {},
+				"ods_component":      {},
+				"region":             {hasDefault: true},
+				"inline":             {hasDefault: true},
+				"object_type":        {},
+				"inline_object_type": {},
+				"nested":             {},
+			},
+		},
+		"tf.json files": {
+			files: map[string]string{
+				"variables.tf.json": `{"variable": {"ods_git_commit_sha": {"type": "string"}, "region": {"default": null}}}`,
+			},
+			want: map[string]variableDeclaration{
+				"ods_git_commit_sha": {},
+				"region":             {hasDefault: true},
+			},
+		},
+		"heredocs": {
+			files: map[string]string{
+				"variables.tf": `variable "described" {
+  description = <<-EOT
+    variable "not_declared" {
+    }
+    default = 1
+  EOT
+}
+
+locals {
+  policy = <<EOF
+}
+variable "also_not_declared" {
+EOF
+}
+
+variable "after_heredoc" {}
+`,
+			},
+			want: map[string]variableDeclaration{
+				"described":     {},
+				"after_heredoc": {},
+			},
+		},
+		"comments": {
+			files: map[string]string{
+				"variables.tf": `# variable "commented" {}
+// variable "commented_too" {}
+/*
+variable "in_block_comment" {
+}
+*/
+variable "region" { # }
+  // default = "eu-west-1"
+  /* default = "eu-west-1" */ type = string
+}
+
+variable "zone" /* { */ {
+  default = "a" # }
+}
+`,
+			},
+			want: map[string]variableDeclaration{
+				"region": {},
+				"zone":   {hasDefault: true},
+			},
+		},
+		"unquoted labels": {
+			files: map[string]string{
+				"variables.tf": "variable hello {}\n\nvariable region {\n  default = \"eu-west-1\"\n}\n",
+			},
+			want: map[string]variableDeclaration{
+				"hello":  {},
+				"region": {hasDefault: true},
+			},
+		},
+		"templates": {
+			files: map[string]string{
+				"variables.tf": `variable "name" {
+  validation {
+    condition     = var.name != "${join("}", ["{"])}"
+    error_message = "Must not be $${x} or %{ if true }}{%{ endif }."
+  }
+}
+
+variable "region" {
+  default = "eu-west-1"
+}
+`,
+			},
+			want: map[string]variableDeclaration{
+				"name":   {},
+				"region": {hasDefault: true},
+			},
+		},
+		"other files are ignored": {
+			files: map[string]string{
+				"terraform.dev.tfvars": "variable \"nope\" {}\n",
+				"README.md":            "variable \"nope\" {}\n",
+			},
+			want: map[string]variableDeclaration{},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := writeFiles(t, tc.files)
+			got, err := declaredVariables(dir)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(variableDeclaration{})); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeclaredVariablesAmbiguous(t *testing.T) {
+	tests := map[string]string{
+		"unclosed brace":         "variable \"hello\" {\n  type = string\n",
+		"unexpected brace":       "variable \"hello\" {}\n}\n",
+		"mismatched bracket":     "variable \"hello\" {\n  type = list(string]\n}\n",
+		"unclosed string":        "variable \"hello {}\n",
+		"unclosed heredoc":       "variable \"hello\" {\n  description = <<EOT\n}\n",
+		"unclosed block comment": "/* variable \"hello\" {}\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"variables.tf": content})
+			if _, err := declaredVariables(dir); err == nil {
+				t.Fatal("want err, got none")
+			}
+		})
+	}
+}
+
+func TestAssignedVariables(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"terraform.tfvars": `hello = "world"
+# comment = 1
+tags = {
+  owner = "me"
+}
+description = <<EOT
+foo = bar
+EOT
+list = [
+  "a",
+]
+`,
+		"terraform.tfvars.json": `{"region": "eu", "tags": {"owner": "me"}}`,
+	})
+	tests := map[string]struct {
+		file string
+		want []string
+	}{
+		"tfvars":      {file: "terraform.tfvars", want: []string{"description", "hello", "list", "tags"}},
+		"tfvars.json": {file: "terraform.tfvars.json", want: []string{"region", "tags"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := assignedVariables(filepath.Join(dir, tc.file))
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMissingVariables(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"variables.tf": `variable "from_auto_tfvars" {}
+variable "from_var_file" {}
+variable "from_secret" {}
+variable "from_env" {}
+variable "from_context" {}
+variable "from_var" {}
+variable "from_extra_args" {}
+variable "with_default" {
+  default = "x"
+}
+variable "missing_a" {}
+variable "missing_b" {}
+`,
+		"foo.auto.tfvars":      `from_auto_tfvars = 1`,
+		"terraform.dev.tfvars": `from_var_file = 1`,
+	})
+	t.Setenv("TF_VAR_from_env", "1")
+	opts := &options{planExtraArgs: "-var from_extra_args=1"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.secretEnvVars = map[string]string{"TF_VAR_from_secret": "1"}
+	d.inputVars = []inputVar{{name: "from_var", value: "1"}}
+	tfConfig := terraformConfig{
+		terraformDir:   dir,
+		varFiles:       []string{"terraform.dev.tfvars"},
+		contextVarsEnv: map[string]string{"TF_VAR_from_context": "1"},
+	}
+	got, err := d.missingVariables(tfConfig)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if diff := cmp.Diff([]string{"missing_a", "missing_b"}, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestOverriddenSensitiveVariables(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"terraform.tfvars":     `db_password = "from-file"`,
+		"terraform.dev.tfvars": "api_token = \"from-file\"\nregion = \"eu\"",
+		"extra.tfvars":         `db_password = "from-extra"`,
+	})
+	opts := &options{planExtraArgs: "-var-file=extra.tfvars"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.inputVars = []inputVar{
+		{name: "db_password", value: "secret", sensitive: true},
+		{name: "api_token", value: "secret", sensitive: true},
+		{name: "region", value: "us"},
+		{name: "unset", value: "secret", sensitive: true},
+	}
+	tfConfig := terraformConfig{
+		terraformDir: dir,
+		varFiles:     []string{"terraform.dev.tfvars"},
+	}
+	got, err := d.overriddenSensitiveVariables(tfConfig)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := []string{
+		"api_token (terraform.dev.tfvars)",
+		"db_password (extra.tfvars)",
+		"db_password (terraform.tfvars)",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	d.inputVars = []inputVar{{name: "region", value: "us"}}
+	got, err = d.overriddenSensitiveVariables(tfConfig)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if len(got) > 0 {
+		t.Fatalf("want no overridden variables without sensitive ones, got %v", got)
+	}
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for f, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestContextVarsEnv(t *testing.T) {
+	opts := &options{targetEnvironment: "dev", build: "foo-abcde"}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{
+		Project:      "proj",
+		Component:    "comp",
+		Repository:   "proj-comp",
+		GitCommitSHA: "0123456789",
+		GitRef:       "main",
+		Namespace:    "proj-cd",
+	}
+	got := d.contextVarsEnv(map[string]variableDeclaration{
+		"hello":                  {},
+		"ods_component":          {},
+		"ods_git_commit_sha":     {},
+		"ods_target_environment": {},
+		"ods_build":              {hasDefault: true},
+	})
+	want := map[string]string{
+		"TF_VAR_ods_component":          "comp",
+		"TF_VAR_ods_git_commit_sha":     "0123456789",
+		"TF_VAR_ods_target_environment": "dev",
+		"TF_VAR_ods_build":              "foo-abcde",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStageFromEnvironment(t *testing.T) {
+	tests := map[string]string{
+		"dev":       "dev",
+		"foo-qa":    "qa",
+		"foo-prod":  "prod",
+		"sandbox":   "",
+		"product":   "",
+		"foo-devel": "",
+	}
+	for env, want := range tests {
+		t.Run(env, func(t *testing.T) {
+			if got := stageFromEnvironment(env); got != want {
+				t.Fatalf("want: %s, got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestVarFileCandidates(t *testing.T) {
+	tests := map[string]struct {
+		stage string
+		env   string
+		want  []string
+	}{
+		"env is stage": {
+			stage: "dev",
+			env:   "dev",
+			want: []string{
+				"terraform.dev.tfvars", "terraform.dev.tfvars.json",
+			},
+		},
+		"env with stage": {
+			stage: "prod",
+			env:   "foo-prod",
+			want: []string{
+				"terraform.prod.tfvars", "terraform.prod.tfvars.json",
+				"terraform.foo-prod.tfvars", "terraform.foo-prod.tfvars.json",
+			},
+		},
+		"env without stage": {
+			env: "sandbox",
+			want: []string{
+				"terraform.sandbox.tfvars", "terraform.sandbox.tfvars.json",
+			},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := varFileCandidates(tc.stage, tc.env)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseInputVars(t *testing.T) {
+	secretEnvVars := map[string]string{"DB_PASSWORD": "s3cr3t"}
+	tests := map[string]struct {
+		vars    []string
+		want    []inputVar
+		wantErr string
+	}{
+		"plain and secret values": {
+			vars: []string{"region=eu-west-1", "tags={a=\"b\"}", "db_password=secret:DB_PASSWORD"},
+			want: []inputVar{
+				{name: "region", value: "eu-west-1"},
+				{name: "tags", value: "{a=\"b\"}"},
+				{name: "db_password", value: "s3cr3t", sensitive: true},
+			},
+		},
+		"empty value": {
+			vars: []string{"empty="},
+			want: []inputVar{{name: "empty", value: ""}},
+		},
+		"missing equal sign": {
+			vars:    []string{"region"},
+			wantErr: "variable 'region' is not of the form name=value",
+		},
+		"invalid name": {
+			vars:    []string{"1region=eu"},
+			wantErr: "variable name '1region' is not a valid identifier",
+		},
+		"unknown secret key": {
+			vars:    []string{"token=secret:TOKEN"},
+			wantErr: "variable 'token' references key 'TOKEN' which is not present in the env secret",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseInputVars(tc.vars, secretEnvVars)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(inputVar{})); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// workDirExcludes are entries of a terraform directory which are not carried
+// over into its scratch copy: the working data of terraform and the backend
+// configuration generated into the checkout by previous versions of this
+// task.
+var workDirExcludes = map[string]bool{
+	".terraform":                       true,
+	backendFilename(backendKubernetes): true,
+}
+
+// overlayDir creates a scratch copy of dir below scratch, mirroring the path
+// of dir relative to root so that relative references (e.g. module sources
+// such as ../modules/foo) still resolve. Instead of copying content, every
+// entry along the path is symlinked, except for the directories on the path
+// itself and workDirExcludes in dir. The path of the copy of dir is returned.
+// If dir is outside of root, only dir itself is mirrored.
+func overlayDir(root, dir, scratch string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		absRoot, rel = filepath.Dir(absDir), filepath.Base(absDir)
+	}
+	parts := []string{}
+	if rel != "." {
+		parts = strings.Split(rel, string(filepath.Separator))
+	}
+	src, dst := absRoot, scratch
+	for i := 0; ; i++ {
+		leaf := i == len(parts)
+		next := ""
+		if !leaf {
+			next = parts[i]
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", src, err)
+		}
+		for _, e := range entries {
+			if e.Name() == next || (leaf && workDirExcludes[e.Name()]) {
+				continue
+			}
+			if err := os.Symlink(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+				return "", fmt.Errorf("link %s: %w", e.Name(), err)
+			}
+		}
+		if leaf {
+			return dst, nil
+		}
+		src, dst = filepath.Join(src, next), filepath.Join(dst, next)
+		if err := os.Mkdir(dst, 0755); err != nil {
+			return "", fmt.Errorf("create %s: %w", dst, err)
+		}
+	}
+}
+
+// prepareWorkDir creates a scratch copy of the terraform config in a
+// temporary directory, which is removed once all steps are done, and renders
+// the backend into it. This leaves the checked out repository untouched.
+func (d *deployTerraform) prepareWorkDir(tfConfig terraformConfig) (string, error) {
+	scratch, err := os.MkdirTemp("", "terraform-work-")
+	if err != nil {
+		return "", fmt.Errorf("create scratch dir: %w", err)
+	}
+	d.addCleanup(func() {
+		if err := os.RemoveAll(scratch); err != nil {
+			d.logger.Warnf("remove scratch dir %s: %s", scratch, err)
+		}
+	})
+	workDir, err := overlayDir(d.opts.checkoutDir, tfConfig.terraformDir, scratch)
+	if err != nil {
+		return "", fmt.Errorf("create scratch copy of %s: %w", tfConfig.terraformDir, err)
+	}
+	if err := d.renderBackend(d.opts.backend, workDir, tfConfig.secretSuffix); err != nil {
+		return "", fmt.Errorf("render backend template failed: %w", err)
+	}
+	return workDir, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opendevstack/ods-pipeline/pkg/pipelinectxt"
+)
+
+func TestOverlayDir(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"terraform/main.tf":                      `module "foo" { source = "../modules/foo" }`,
+		"terraform/backend-kubernetes.tf":        `terraform {}`,
+		"terraform/backend-s3.tf":                `resource "aws_s3_bucket" "state" {}`,
+		"terraform/.terraform/terraform.tfstate": `{}`,
+		"modules/foo/main.tf":                    `variable "a" {}`,
+		"README.md":                              "readme",
+	})
+	scratch := t.TempDir()
+	workDir, err := overlayDir(root, filepath.Join(root, "terraform"), scratch)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if want := filepath.Join(scratch, "terraform"); workDir != want {
+		t.Fatalf("want work dir %s, got %s", want, workDir)
+	}
+	for _, f := range []string{"main.tf", "backend-s3.tf", "../modules/foo/main.tf", "../README.md"} {
+		if _, err := os.Stat(filepath.Join(workDir, f)); err != nil {
+			t.Fatalf("want %s in scratch copy, got %s", f, err)
+		}
+	}
+	for _, f := range []string{"backend-kubernetes.tf", ".terraform"} {
+		if _, err := os.Lstat(filepath.Join(workDir, f)); !os.IsNotExist(err) {
+			t.Fatalf("want %s excluded from scratch copy, got %v", f, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "outputs.tf"), []byte("output \"a\" {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "terraform", "outputs.tf")); !os.IsNotExist(err) {
+		t.Fatalf("want checkout untouched, got %v", err)
+	}
+}
+
+func TestPrepareWorkDir(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"terraform/main.tf": `variable "a" {}`,
+	})
+	opts := &options{checkoutDir: root, backend: backendKubernetes}
+	d := deployTerraformFromOptions(opts, io.Discard, io.Discard)
+	d.ctxt = &pipelinectxt.ODSContext{Namespace: "foo-cd"}
+	workDir, err := d.prepareWorkDir(terraformConfig{terraformDir: filepath.Join(root, "terraform"), secretSuffix: "foo-dev"})
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "backend-kubernetes.tf")); err != nil {
+		t.Fatalf("want backend rendered into scratch copy, got %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "terraform", "backend-kubernetes.tf")); !os.IsNotExist(err) {
+		t.Fatalf("want checkout untouched, got %v", err)
+	}
+	d.cleanup()
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Fatalf("want scratch copy removed, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAWSSTSEndpoint            = "https://sts.amazonaws.com"
+	DefaultGCPSTSEndpoint            = "https://sts.googleapis.com"
+	DefaultGCPIAMCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+
+	gcpCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	defaultTimeout        = 30 * time.Second
+)
+
+// Exchanger exchanges a Kubernetes service account token for short-lived
+// cloud credentials, returned as env variables understood by the
+// respective Terraform providers.
+type Exchanger struct {
+	AWSSTSEndpoint            string
+	GCPSTSEndpoint            string
+	GCPIAMCredentialsEndpoint string
+	HTTPClient                *http.Client
+}
+
+// NewExchanger returns an exchanger using the public cloud endpoints.
+func NewExchanger() *Exchanger {
+	return &Exchanger{
+		AWSSTSEndpoint:            DefaultAWSSTSEndpoint,
+		GCPSTSEndpoint:            DefaultGCPSTSEndpoint,
+		GCPIAMCredentialsEndpoint: DefaultGCPIAMCredentialsEndpoint,
+		HTTPClient:                &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      string
+		}
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+// AWS assumes roleARN via AssumeRoleWithWebIdentity.
+func (e *Exchanger) AWS(token, roleARN, sessionName string) (map[string]string, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {token},
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(e.AWSSTSEndpoint, "/")+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	b, err := e.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("assume role %s: %w", roleARN, err)
+	}
+	var r assumeRoleWithWebIdentityResponse
+	if err := xml.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("parse AssumeRoleWithWebIdentity response: %w", err)
+	}
+	c := r.Result.Credentials
+	if c.AccessKeyId == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("assume role %s: no credentials in response", roleARN)
+	}
+	return map[string]string{
+		"AWS_ACCESS_KEY_ID":     c.AccessKeyId,
+		"AWS_SECRET_ACCESS_KEY": c.SecretAccessKey,
+		"AWS_SESSION_TOKEN":     c.SessionToken,
+	}, nil
+}
+
+// Azure returns env variables letting the azurerm provider and backend
+// authenticate with a federated credential, using token as client assertion.
+// The exchange itself is done by the provider.
+func Azure(token, tenantID, clientID string) map[string]string {
+	return map[string]string{
+		"ARM_USE_OIDC":   "true",
+		"ARM_OIDC_TOKEN": token,
+		"ARM_TENANT_ID":  tenantID,
+		"ARM_CLIENT_ID":  clientID,
+	}
+}
+
+// GCP exchanges token for an access token via workload identity federation.
+// audience is the full resource name of the workload identity pool provider.
+// If serviceAccount is not empty, the federated token is used to impersonate it.
+func (e *Exchanger) GCP(token, audience, serviceAccount string) (map[string]string, error) {
+	body, err := json.Marshal(map[string]string{
+		"grantType":          "urn:ietf:params:oauth:grant-type:token-exchange",
+		"audience":           audience,
+		"scope":              gcpCloudPlatformScope,
+		"requestedTokenType": "urn:ietf:params:oauth:token-type:access_token",
+		"subjectToken":       token,
+		"subjectTokenType":   "urn:ietf:params:oauth:token-type:jwt",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(e.GCPSTSEndpoint, "/")+"/v1/token", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	b, err := e.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange token for %s: %w", audience, err)
+	}
+	var sts struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &sts); err != nil || sts.AccessToken == "" {
+		return nil, fmt.Errorf("exchange token for %s: no access token in response", audience)
+	}
+	accessToken := sts.AccessToken
+
+	if serviceAccount != "" {
+		body, err := json.Marshal(map[string][]string{"scope": {gcpCloudPlatformScope}})
+		if err != nil {
+			return nil, err
+		}
+		u := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", strings.TrimSuffix(e.GCPIAMCredentialsEndpoint, "/"), url.PathEscape(serviceAccount))
+		req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		b, err := e.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("impersonate %s: %w", serviceAccount, err)
+		}
+		var iam struct {
+			AccessToken string `json:"accessToken"`
+		}
+		if err := json.Unmarshal(b, &iam); err != nil || iam.AccessToken == "" {
+			return nil, fmt.Errorf("impersonate %s: no access token in response", serviceAccount)
+		}
+		accessToken = iam.AccessToken
+	}
+	return map[string]string{
+		"GOOGLE_OAUTH_ACCESS_TOKEN": accessToken,
+	}, nil
+}
+
+func (e *Exchanger) do(req *http.Request) ([]byte, error) {
+	res, err := e.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
@@ -0,0 +1,100 @@
+package identity
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func newTestExchanger(t *testing.T, handler http.Handler) *Exchanger {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	e := NewExchanger()
+	e.AWSSTSEndpoint = srv.URL
+	e.GCPSTSEndpoint = srv.URL
+	e.GCPIAMCredentialsEndpoint = srv.URL
+	return e
+}
+
+func TestAWS(t *testing.T) {
+	e := newTestExchanger(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "sa-jwt" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<ErrorResponse><Error><Code>AccessDenied</Code></Error></ErrorResponse>"))
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>2026-10-19T12:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+
+	got, err := e.AWS("sa-jwt", "arn:aws:iam::123456789012:role/terraform", "ods-foo-dev")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "ASIAEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "session",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := e.AWS("other-jwt", "arn:aws:iam::123456789012:role/terraform", "ods-foo-dev"); err == nil {
+		t.Fatal("want err, got none")
+	}
+}
+
+func TestGCP(t *testing.T) {
+	audience := "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/ods"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["subjectToken"] != "sa-jwt" || body["audience"] != audience {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token": "federated-token", "token_type": "Bearer"}`))
+	})
+	mux.HandleFunc("/v1/projects/-/serviceAccounts/terraform@proj.iam.gserviceaccount.com:generateAccessToken", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer federated-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"accessToken": "sa-token"}`))
+	})
+	e := newTestExchanger(t, mux)
+
+	tests := map[string]struct {
+		serviceAccount string
+		want           string
+	}{
+		"federated token":    {want: "federated-token"},
+		"impersonated token": {serviceAccount: "terraform@proj.iam.gserviceaccount.com", want: "sa-token"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := e.GCP("sa-jwt", audience, tc.serviceAccount)
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(map[string]string{"GOOGLE_OAUTH_ACCESS_TOKEN": tc.want}, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Access describes an action on a resource in a namespace.
+type Access struct {
+	Namespace string
+	Verb      string
+	Group     string
+	Resource  string
+}
+
+func (a Access) String() string {
+	resource := a.Resource
+	if a.Group != "" {
+		resource = fmt.Sprintf("%s.%s", a.Resource, a.Group)
+	}
+	return fmt.Sprintf("%s %s in namespace %s", a.Verb, resource, a.Namespace)
+}
+
+// DeniedAccess returns those of the given accesses which are not allowed for
+// the user of the clientset.
+func DeniedAccess(clientset k8s.Interface, accesses []Access) ([]Access, error) {
+	denied := []Access{}
+	for _, a := range accesses {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(
+			context.TODO(),
+			&authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: a.Namespace,
+						Verb:      a.Verb,
+						Group:     a.Group,
+						Resource:  a.Resource,
+					},
+				},
+			},
+			metav1.CreateOptions{},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("review access to %s: %w", a, err)
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, a)
+		}
+	}
+	return denied, nil
+}
@@ -0,0 +1,41 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDeniedAccess(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = attrs.Namespace == "ci" || (attrs.Resource == "secrets" && attrs.Verb == "get")
+		return true, review, nil
+	})
+	accesses := []Access{
+		{Namespace: "ci", Verb: "create", Resource: "secrets"},
+		{Namespace: "prod", Verb: "get", Resource: "secrets"},
+		{Namespace: "prod", Verb: "create", Resource: "secrets"},
+		{Namespace: "prod", Verb: "create", Group: "coordination.k8s.io", Resource: "leases"},
+	}
+	got, err := DeniedAccess(clientset, accesses)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := []Access{
+		{Namespace: "prod", Verb: "create", Resource: "secrets"},
+		{Namespace: "prod", Verb: "create", Group: "coordination.k8s.io", Resource: "leases"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	if want, got := "create leases.coordination.k8s.io in namespace prod", got[1].String(); want != got {
+		t.Fatalf("want: %s, got: %s", want, got)
+	}
+}
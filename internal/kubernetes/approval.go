@@ -0,0 +1,144 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Keys and values of the ConfigMap through which an apply is approved.
+const (
+	ApprovalLabel       = "terraform-approval"
+	ApprovalSummaryKey  = "summary"
+	ApprovalStatusKey   = "status"
+	ApprovalApproverKey = "approver"
+	ApprovalReasonKey   = "reason"
+
+	ApprovalStatusPending  = "pending"
+	ApprovalStatusApproved = "approved"
+	ApprovalStatusRejected = "rejected"
+)
+
+// ApprovalConfigMapName returns the name of the ConfigMap through which the
+// apply of the given build is approved.
+func ApprovalConfigMapName(build string) string {
+	return fmt.Sprintf("terraform-approval-%s", build)
+}
+
+// RequestApproval creates (or resets) the approval ConfigMap with the given
+// plan summary and status pending.
+func RequestApproval(clientset k8s.Interface, namespace, name, summary string) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{ApprovalLabel: "true"},
+		},
+		Data: map[string]string{
+			ApprovalSummaryKey: summary,
+			ApprovalStatusKey:  ApprovalStatusPending,
+		},
+	}
+	log.Printf("Create approval configmap %s in namespace %s", name, namespace)
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = clientset.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+// DeleteApproval deletes the approval ConfigMap. A ConfigMap which does not
+// exist (anymore) is not an error.
+func DeleteApproval(clientset k8s.Interface, namespace, name string) error {
+	log.Printf("Delete approval configmap %s in namespace %s", name, namespace)
+	err := clientset.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Approval is the decision recorded in the approval ConfigMap.
+type Approval struct {
+	Status string
+	// Approver is the value of the approver key, which is self-declared by
+	// whoever set the status.
+	Approver string
+	Reason   string
+	// StatusManager is the field manager which last set the status according
+	// to the managed fields of the ConfigMap (e.g. kubectl-patch). It names
+	// the client which was used, not an authenticated user, and is empty if
+	// not recorded.
+	StatusManager string
+	// StatusTime is the time at which StatusManager set the status.
+	StatusTime time.Time
+}
+
+// statusManager returns the field manager owning the status key of cm and
+// the time at which it last changed the ConfigMap, as recorded in its managed
+// fields.
+func statusManager(cm *corev1.ConfigMap) (string, time.Time) {
+	for _, entry := range cm.ManagedFields {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Data map[string]json.RawMessage `json:"f:data"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields.Data["f:"+ApprovalStatusKey]; !ok {
+			continue
+		}
+		var t time.Time
+		if entry.Time != nil {
+			t = entry.Time.Time
+		}
+		return entry.Manager, t
+	}
+	return "", time.Time{}
+}
+
+// WaitForApproval polls the approval ConfigMap every interval until its
+// status is approved or rejected, and returns the decision. An error is
+// returned if ctx is done before.
+func WaitForApproval(ctx context.Context, clientset k8s.Interface, namespace, name string, interval time.Duration) (*Approval, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("get approval configmap %s: %w", name, err)
+		}
+		switch status := cm.Data[ApprovalStatusKey]; status {
+		case ApprovalStatusApproved, ApprovalStatusRejected:
+			manager, t := statusManager(cm)
+			return &Approval{
+				Status:        status,
+				Approver:      cm.Data[ApprovalApproverKey],
+				Reason:        cm.Data[ApprovalReasonKey],
+				StatusManager: manager,
+				StatusTime:    t,
+			}, nil
+		case ApprovalStatusPending:
+		default:
+			log.Printf("Ignoring unknown status %q of approval configmap %s", status, name)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWaitForApproval(t *testing.T) {
+	approvalRequested := metav1.NewTime(time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC))
+	approvalGiven := metav1.NewTime(time.Date(2024, 1, 5, 10, 5, 0, 0, time.UTC))
+	tests := map[string]struct {
+		// data returned by the n-th get, the last one is repeated.
+		data          []map[string]string
+		managedFields []metav1.ManagedFieldsEntry
+		timeout       time.Duration
+		want          *Approval
+		wantErr       error
+	}{
+		"approved after a while": {
+			data: []map[string]string{
+				{ApprovalStatusKey: ApprovalStatusPending},
+				{ApprovalStatusKey: "maybe"},
+				{ApprovalStatusKey: ApprovalStatusApproved, ApprovalApproverKey: "jane"},
+			},
+			timeout: time.Second,
+			want:    &Approval{Status: ApprovalStatusApproved, Approver: "jane"},
+		},
+		"approved with managed fields": {
+			data: []map[string]string{
+				{ApprovalStatusKey: ApprovalStatusApproved, ApprovalApproverKey: "jane"},
+			},
+			managedFields: []metav1.ManagedFieldsEntry{
+				{
+					Manager:  "deploy-terraform",
+					Time:     &approvalRequested,
+					FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:data":{".":{},"f:summary":{}},"f:metadata":{"f:labels":{}}}`)},
+				},
+				{
+					Manager:  "kubectl-patch",
+					Time:     &approvalGiven,
+					FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:approver":{},"f:status":{}}}`)},
+				},
+			},
+			timeout: time.Second,
+			want: &Approval{
+				Status:        ApprovalStatusApproved,
+				Approver:      "jane",
+				StatusManager: "kubectl-patch",
+				StatusTime:    approvalGiven.Time,
+			},
+		},
+		"rejected": {
+			data: []map[string]string{
+				{ApprovalStatusKey: ApprovalStatusRejected, ApprovalApproverKey: "joe", ApprovalReasonKey: "too risky"},
+			},
+			timeout: time.Second,
+			want:    &Approval{Status: ApprovalStatusRejected, Approver: "joe", Reason: "too risky"},
+		},
+		"timeout": {
+			data:    []map[string]string{{ApprovalStatusKey: ApprovalStatusPending}},
+			timeout: 50 * time.Millisecond,
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if err := RequestApproval(clientset, "ns", "terraform-approval-foo", "Plan: 1 to add"); err != nil {
+				t.Fatal(err)
+			}
+			gets := 0
+			clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				data := tc.data[len(tc.data)-1]
+				if gets < len(tc.data) {
+					data = tc.data[gets]
+				}
+				gets++
+				return true, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{ManagedFields: tc.managedFields}, Data: data}, nil
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			got, err := WaitForApproval(ctx, clientset, "ns", "terraform-approval-foo", time.Millisecond)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want err %v, got %v", tc.wantErr, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("approval mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRequestApprovalResets(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if err := RequestApproval(clientset, "ns", "terraform-approval-foo", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RequestApproval(clientset, "ns", "terraform-approval-foo", "new"); err != nil {
+		t.Fatalf("want no err when configmap exists, got %s", err)
+	}
+	data, err := GetConfigMapData(clientset, "ns", "terraform-approval-foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{ApprovalSummaryKey: "new", ApprovalStatusKey: ApprovalStatusPending}
+	if diff := cmp.Diff(want, data); diff != "" {
+		t.Fatalf("data mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeleteApproval(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if err := RequestApproval(clientset, "ns", "terraform-approval-foo", "summary"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := DeleteApproval(clientset, "ns", "terraform-approval-foo"); err != nil {
+			t.Fatalf("want no err on delete %d, got %s", i+1, err)
+		}
+	}
+	if _, err := GetConfigMapData(clientset, "ns", "terraform-approval-foo"); err == nil {
+		t.Fatal("want approval configmap to be deleted")
+	}
+}
@@ -0,0 +1,36 @@
+package kubernetes
+
+import (
+	"context"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+func GetConfigMap(clientset k8s.Interface, namespace string, configMapName string) (*corev1.ConfigMap, error) {
+
+	log.Printf("Get configmap %s in namespace %s", configMapName, namespace)
+
+	configMap, err := clientset.CoreV1().
+		ConfigMaps(namespace).
+		Get(context.TODO(), configMapName, metav1.GetOptions{})
+
+	return configMap, err
+}
+
+func GetConfigMapData(clientset k8s.Interface, namespace string, configMapName string) (map[string]string, error) {
+	configMap, err := GetConfigMap(clientset, namespace, configMapName)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	for key, value := range configMap.Data {
+		data[key] = value
+	}
+	for key, value := range configMap.BinaryData {
+		data[key] = string(value)
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// StateLockInfoAnnotation is the annotation in which the Terraform
+// Kubernetes backend stores information about the holder of a state lock.
+const StateLockInfoAnnotation = "app.terraform.io/lock-info"
+
+// StateLeaseName returns the name of the lease the Terraform Kubernetes
+// backend uses to lock the state stored in secret secretName.
+func StateLeaseName(secretName string) string {
+	return "lock-" + secretName
+}
+
+// stateLockInfo mirrors the lock info written by Terraform, so that
+// terraform reports who holds a lock taken by this task.
+type stateLockInfo struct {
+	ID        string
+	Operation string
+	Info      string
+	Who       string
+	Version   string
+	Created   time.Time
+	Path      string
+}
+
+// StateLock is a lock on the state of a state secret taken by LockState.
+type StateLock struct {
+	clientset k8s.Interface
+	namespace string
+	name      string
+	created   bool
+}
+
+// LockState takes the lease Terraform uses to lock the state stored in
+// secretName, the same way Terraform does, so that neither Terraform nor
+// another task run can use the state until Unlock is called. It fails if the
+// state is locked already.
+func LockState(clientset k8s.Interface, namespace, secretName, holder, operation string) (*StateLock, error) {
+	name := StateLeaseName(secretName)
+	info, err := json.Marshal(stateLockInfo{ID: holder, Operation: operation, Who: holder, Created: time.Now().UTC(), Path: secretName})
+	if err != nil {
+		return nil, err
+	}
+	leases := clientset.CoordinationV1().Leases(namespace)
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Annotations: map[string]string{StateLockInfoAnnotation: string(info)},
+			},
+			Spec: coordinationv1.LeaseSpec{HolderIdentity: &holder},
+		}
+		log.Printf("Lock state secret %s in namespace %s", secretName, namespace)
+		if _, err := leases.Create(context.TODO(), lease, metav1.CreateOptions{}); err != nil {
+			return nil, fmt.Errorf("create lease %s: %w", name, err)
+		}
+		return &StateLock{clientset: clientset, namespace: namespace, name: name, created: true}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get lease %s: %w", name, err)
+	}
+	if lease.Spec.HolderIdentity != nil {
+		return nil, fmt.Errorf("state secret %s is locked by %s", secretName, *lease.Spec.HolderIdentity)
+	}
+	lease.Spec.HolderIdentity = &holder
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[StateLockInfoAnnotation] = string(info)
+	log.Printf("Lock state secret %s in namespace %s", secretName, namespace)
+	// Update fails if the lease was changed since it was read.
+	if _, err := leases.Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("update lease %s: %w", name, err)
+	}
+	return &StateLock{clientset: clientset, namespace: namespace, name: name}, nil
+}
+
+// Unlock releases the lock. A lease created by LockState is deleted again.
+func (l *StateLock) Unlock() error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	if l.created {
+		if err := leases.Delete(context.TODO(), l.name, metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("delete lease %s: %w", l.name, err)
+		}
+		return nil
+	}
+	lease, err := leases.Get(context.TODO(), l.name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get lease %s: %w", l.name, err)
+	}
+	lease.Spec.HolderIdentity = nil
+	delete(lease.Annotations, StateLockInfoAnnotation)
+	if _, err := leases.Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("update lease %s: %w", l.name, err)
+	}
+	return nil
+}
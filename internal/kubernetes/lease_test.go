@@ -0,0 +1,72 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func stateLease(secretName string, holder *string) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: StateLeaseName(secretName), Namespace: "ns"},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: holder},
+	}
+}
+
+func TestLockState(t *testing.T) {
+	other := "3f2e6a7c-terraform"
+	clientset := fake.NewSimpleClientset(
+		stateLease("tfstate-default-foo-dev", nil),
+		stateLease("tfstate-default-bar-dev", &other),
+	)
+	leases := clientset.CoordinationV1().Leases("ns")
+
+	lock, err := LockState(clientset, "ns", "tfstate-default-foo-dev", "foo-deploy-abcde", "migrate-state")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	lease, err := leases.Get(context.TODO(), "lock-tfstate-default-foo-dev", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "foo-deploy-abcde" {
+		t.Fatalf("want lease held by foo-deploy-abcde, got %v", lease.Spec.HolderIdentity)
+	}
+	if lease.Annotations[StateLockInfoAnnotation] == "" {
+		t.Fatal("want lock info annotation, got none")
+	}
+	if _, err := LockState(clientset, "ns", "tfstate-default-foo-dev", "foo-deploy-fghij", "migrate-state"); err == nil {
+		t.Fatal("want err for state locked by other run, got none")
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	lease, err = leases.Get(context.TODO(), "lock-tfstate-default-foo-dev", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity != nil {
+		t.Fatalf("want lease released, got holder %s", *lease.Spec.HolderIdentity)
+	}
+
+	_, err = LockState(clientset, "ns", "tfstate-default-bar-dev", "foo-deploy-abcde", "migrate-state")
+	if err == nil || err.Error() != "state secret tfstate-default-bar-dev is locked by "+other {
+		t.Fatalf("want err for state locked by terraform, got %v", err)
+	}
+
+	lock, err = LockState(clientset, "ns", "tfstate-default-baz-dev", "foo-deploy-abcde", "migrate-state")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	_, err = leases.Get(context.TODO(), "lock-tfstate-default-baz-dev", metav1.GetOptions{})
+	if !errors.IsNotFound(err) {
+		t.Fatalf("want created lease deleted, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Name and key of the secret holding the key with which plan bundles are
+// encrypted.
+const (
+	PlanKeySecretName = "terraform-plan-key"
+	PlanKeySecretKey  = "key"
+	// PlanKeySize is the size of the key in bytes (AES-256).
+	PlanKeySize = 32
+)
+
+// GetPlanKey returns the key with which plan bundles are encrypted. If the
+// secret holding it does not exist yet and create is set, it is created with
+// a random key.
+func GetPlanKey(clientset k8s.Interface, namespace string, create bool) ([]byte, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), PlanKeySecretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) && create {
+		key := make([]byte, PlanKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+		log.Printf("Create secret %s in namespace %s", PlanKeySecretName, namespace)
+		secret, err = clientset.CoreV1().Secrets(namespace).Create(context.TODO(), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: PlanKeySecretName, Namespace: namespace},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{PlanKeySecretKey: key},
+		}, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			// Created concurrently by another task run.
+			secret, err = clientset.CoreV1().Secrets(namespace).Get(context.TODO(), PlanKeySecretName, metav1.GetOptions{})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := secret.Data[PlanKeySecretKey]
+	if len(key) != PlanKeySize {
+		return nil, fmt.Errorf("key %s of secret %s has %d bytes instead of %d", PlanKeySecretKey, PlanKeySecretName, len(key), PlanKeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,43 @@
+package kubernetes
+
+import (
+	"bytes"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetPlanKey(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if _, err := GetPlanKey(clientset, "ns", false); err == nil {
+		t.Fatal("want err for missing key, got none")
+	}
+	created, err := GetPlanKey(clientset, "ns", true)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if len(created) != PlanKeySize {
+		t.Fatalf("want key of %d bytes, got %d", PlanKeySize, len(created))
+	}
+	got, err := GetPlanKey(clientset, "ns", false)
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if !bytes.Equal(created, got) {
+		t.Fatal("want created key to be returned")
+	}
+}
+
+func TestGetPlanKeyInvalid(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: PlanKeySecretName, Namespace: "ns"},
+		Data:       map[string][]byte{PlanKeySecretKey: []byte("short")},
+	})
+	_, err := GetPlanKey(clientset, "ns", true)
+	want := "key key of secret terraform-plan-key has 5 bytes instead of 32"
+	if err == nil || err.Error() != want {
+		t.Fatalf("want err: %s, got: %v", want, err)
+	}
+}
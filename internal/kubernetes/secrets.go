@@ -4,12 +4,23 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
+// supportedSecretTypes lists the secret types GetSecrets can derive values from.
+var supportedSecretTypes = map[corev1.SecretType]bool{
+	corev1.SecretTypeOpaque:           true,
+	corev1.SecretTypeBasicAuth:        true,
+	corev1.SecretTypeSSHAuth:          true,
+	corev1.SecretTypeDockerConfigJson: true,
+	corev1.SecretTypeTLS:              true,
+}
+
 func GetSecret(clientset k8s.Interface, namespace string, secretName string) (*corev1.Secret, error) {
 
 	log.Printf("Get secret %s in namespace %s", secretName, namespace)
@@ -21,17 +32,53 @@ func GetSecret(clientset k8s.Interface, namespace string, secretName string) (*c
 	return secret, err
 }
 
+// GetSecrets returns the data of the secret. The keys of secrets which are not
+// of type Opaque (such as tls.crt or .dockerconfigjson) are converted into
+// valid env variable names (TLS_CRT, DOCKERCONFIGJSON). It fails if two keys
+// are converted into the same name (e.g. a.b and a-b), as one value would
+// silently replace the other.
 func GetSecrets(clientset k8s.Interface, namespace string, secretName string) (map[string]string, error) {
 	secret, err := GetSecret(clientset, namespace, secretName)
 	if err != nil {
 		return nil, err
 	}
-	if secret.Type != "Opaque" {
-		return nil, fmt.Errorf("secret type is not Opaque")
+	if !supportedSecretTypes[secret.Type] {
+		return nil, fmt.Errorf("secret type %s is not supported", secret.Type)
+	}
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 	secrets := make(map[string]string)
-	for key, value := range secret.Data {
-		secrets[key] = string(value)
+	origins := make(map[string]string)
+	for _, key := range keys {
+		name := key
+		if secret.Type != corev1.SecretTypeOpaque {
+			name = EnvVarName(key)
+		}
+		if origin, ok := origins[name]; ok {
+			return nil, fmt.Errorf("keys %s and %s of secret %s both map to env variable %s", origin, key, secretName, name)
+		}
+		origins[name] = key
+		secrets[name] = string(secret.Data[key])
 	}
 	return secrets, nil
 }
+
+// EnvVarName converts key into a valid env variable name by upper-casing it
+// and replacing any character other than letters, digits and underscores
+// with an underscore. Leading separators are dropped.
+func EnvVarName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return strings.TrimLeft(name, "_")
+}
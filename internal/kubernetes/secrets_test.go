@@ -0,0 +1,77 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetSecrets(t *testing.T) {
+	tests := map[string]struct {
+		secretType corev1.SecretType
+		data       map[string][]byte
+		want       map[string]string
+		wantErr    string
+	}{
+		"opaque": {
+			secretType: corev1.SecretTypeOpaque,
+			data:       map[string][]byte{"TF_VAR_hello": []byte("world"), "lower.key": []byte("x")},
+			want:       map[string]string{"TF_VAR_hello": "world", "lower.key": "x"},
+		},
+		"basic-auth": {
+			secretType: corev1.SecretTypeBasicAuth,
+			data:       map[string][]byte{"username": []byte("user"), "password": []byte("s3cr3t")},
+			want:       map[string]string{"USERNAME": "user", "PASSWORD": "s3cr3t"},
+		},
+		"ssh-auth": {
+			secretType: corev1.SecretTypeSSHAuth,
+			data:       map[string][]byte{"ssh-privatekey": []byte("key")},
+			want:       map[string]string{"SSH_PRIVATEKEY": "key"},
+		},
+		"dockerconfigjson": {
+			secretType: corev1.SecretTypeDockerConfigJson,
+			data:       map[string][]byte{".dockerconfigjson": []byte("{}")},
+			want:       map[string]string{"DOCKERCONFIGJSON": "{}"},
+		},
+		"tls": {
+			secretType: corev1.SecretTypeTLS,
+			data:       map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")},
+			want:       map[string]string{"TLS_CRT": "crt", "TLS_KEY": "key"},
+		},
+		"colliding keys": {
+			secretType: corev1.SecretTypeTLS,
+			data:       map[string][]byte{"tls.crt": []byte("crt"), "tls-crt": []byte("other")},
+			wantErr:    "keys tls-crt and tls.crt of secret s both map to env variable TLS_CRT",
+		},
+		"service account token": {
+			secretType: corev1.SecretTypeServiceAccountToken,
+			data:       map[string][]byte{"token": []byte("t")},
+			wantErr:    "secret type kubernetes.io/service-account-token is not supported",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "s", Namespace: "ns"},
+				Type:       tc.secretType,
+				Data:       tc.data,
+			})
+			got, err := GetSecrets(clientset, "ns", "s")
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("want err: %s, got: %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no err, got %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
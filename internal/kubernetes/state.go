@@ -0,0 +1,127 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8s "k8s.io/client-go/kubernetes"
+)
+
+// Labels set by the Terraform Kubernetes backend on state secrets.
+const (
+	StateLabel             = "tfstate"
+	StateSecretSuffixLabel = "tfstateSecretSuffix"
+	StateWorkspaceLabel    = "tfstateWorkspace"
+)
+
+// StateSecretName returns the name of the secret the Terraform Kubernetes
+// backend stores the state of workspace in.
+func StateSecretName(workspace, secretSuffix string) string {
+	return fmt.Sprintf("tfstate-%s-%s", workspace, secretSuffix)
+}
+
+// ListStateSecrets returns the state secrets (of all workspaces) with the
+// given secret suffix.
+func ListStateSecrets(clientset k8s.Interface, namespace string, secretSuffix string) ([]corev1.Secret, error) {
+	list, err := clientset.CoreV1().
+		Secrets(namespace).
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=true,%s=%s", StateLabel, StateSecretSuffixLabel, secretSuffix),
+		})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// MoveStateSecrets moves the state secrets of all workspaces from
+// fromSuffix to toSuffix, adding the given labels. Nothing is moved if no
+// state exists for fromSuffix. Moving fails if state exists for both
+// suffixes. The state of both the previous and the new secrets is locked
+// for holder while moving, and moving fails if it is locked already. All
+// secrets are created before any of the previous ones is deleted. If
+// creating one fails, the secrets created so far are deleted again. The
+// names of the created secrets are returned.
+func MoveStateSecrets(clientset k8s.Interface, namespace, fromSuffix, toSuffix string, labels map[string]string, holder string) (moved []string, err error) {
+	from, err := ListStateSecrets(clientset, namespace, fromSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("list state secrets with suffix %s: %w", fromSuffix, err)
+	}
+	if len(from) == 0 {
+		return nil, nil
+	}
+	to, err := ListStateSecrets(clientset, namespace, toSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("list state secrets with suffix %s: %w", toSuffix, err)
+	}
+	if len(to) > 0 {
+		return nil, fmt.Errorf("state secrets exist for both suffix %s and %s, refusing to move", fromSuffix, toSuffix)
+	}
+	locks := []*StateLock{}
+	defer func() {
+		for _, l := range locks {
+			if uerr := l.Unlock(); uerr != nil {
+				if err == nil {
+					err = fmt.Errorf("unlock state: %w", uerr)
+				} else {
+					err = fmt.Errorf("%w; unlock state: %s", err, uerr)
+				}
+			}
+		}
+	}()
+	for _, s := range from {
+		for _, name := range []string{s.Name, StateSecretName(s.Labels[StateWorkspaceLabel], toSuffix)} {
+			lock, err := LockState(clientset, namespace, name, holder, "migrate-state")
+			if err != nil {
+				return nil, fmt.Errorf("lock state: %w", err)
+			}
+			locks = append(locks, lock)
+		}
+	}
+	secrets := clientset.CoreV1().Secrets(namespace)
+	moved = []string{}
+	for _, s := range from {
+		workspace := s.Labels[StateWorkspaceLabel]
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        StateSecretName(workspace, toSuffix),
+				Namespace:   namespace,
+				Labels:      map[string]string{},
+				Annotations: s.Annotations,
+			},
+			Type: s.Type,
+			Data: s.Data,
+		}
+		for k, v := range s.Labels {
+			secret.Labels[k] = v
+		}
+		for k, v := range labels {
+			secret.Labels[k] = v
+		}
+		secret.Labels[StateSecretSuffixLabel] = toSuffix
+		log.Printf("Copy state secret %s to %s in namespace %s", s.Name, secret.Name, namespace)
+		_, err := secrets.Create(context.TODO(), secret, metav1.CreateOptions{})
+		if err != nil {
+			err = fmt.Errorf("create state secret %s: %w", secret.Name, err)
+			for _, name := range moved {
+				log.Printf("Roll back: delete state secret %s in namespace %s", name, namespace)
+				if derr := secrets.Delete(context.TODO(), name, metav1.DeleteOptions{}); derr != nil {
+					err = fmt.Errorf("%w; roll back: delete state secret %s: %s", err, name, derr)
+				}
+			}
+			return nil, err
+		}
+		moved = append(moved, secret.Name)
+	}
+	for _, s := range from {
+		log.Printf("Delete state secret %s in namespace %s", s.Name, namespace)
+		err := secrets.Delete(context.TODO(), s.Name, metav1.DeleteOptions{})
+		if err != nil {
+			return moved, fmt.Errorf("delete state secret %s (state was copied to suffix %s already): %w", s.Name, toSuffix, err)
+		}
+	}
+	return moved, nil
+}
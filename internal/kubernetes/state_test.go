@@ -0,0 +1,149 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func stateSecret(workspace, suffix string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      StateSecretName(workspace, suffix),
+			Namespace: "ns",
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "terraform",
+				StateLabel:                     "true",
+				StateSecretSuffixLabel:         suffix,
+				StateWorkspaceLabel:            workspace,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"tfstate": []byte(workspace)},
+	}
+}
+
+func TestMoveStateSecrets(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		stateSecret("default", "foo-dev"),
+		stateSecret("feature", "foo-dev"),
+		stateSecret("default", "bar-dev"),
+	)
+	moved, err := MoveStateSecrets(clientset, "ns", "foo-dev", "proj-repo-foo-dev", map[string]string{"team": "a"}, "foo-deploy-abcde")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	if diff := cmp.Diff([]string{"tfstate-default-proj-repo-foo-dev", "tfstate-feature-proj-repo-foo-dev"}, moved); diff != "" {
+		t.Fatalf("moved mismatch (-want +got):\n%s", diff)
+	}
+	secret, err := clientset.CoreV1().Secrets("ns").Get(context.TODO(), "tfstate-feature-proj-repo-foo-dev", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := map[string]string{
+		"app.kubernetes.io/managed-by": "terraform",
+		StateLabel:                     "true",
+		StateSecretSuffixLabel:         "proj-repo-foo-dev",
+		StateWorkspaceLabel:            "feature",
+		"team":                         "a",
+	}
+	if diff := cmp.Diff(wantLabels, secret.Labels); diff != "" {
+		t.Fatalf("labels mismatch (-want +got):\n%s", diff)
+	}
+	if string(secret.Data["tfstate"]) != "feature" {
+		t.Fatalf("unexpected state: %s", secret.Data["tfstate"])
+	}
+	remaining, err := ListStateSecrets(clientset, "ns", "foo-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Fatalf("want old state secrets removed, got %d", len(remaining))
+	}
+	leases, err := clientset.CoordinationV1().Leases("ns").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Items) != 0 {
+		t.Fatalf("want state locks released, got %d leases", len(leases.Items))
+	}
+
+	moved, err = MoveStateSecrets(clientset, "ns", "foo-dev", "proj-repo-foo-dev", nil, "foo-deploy-abcde")
+	if err != nil || len(moved) != 0 {
+		t.Fatalf("want nothing moved, got %v, %v", moved, err)
+	}
+
+	_, err = MoveStateSecrets(clientset, "ns", "bar-dev", "proj-repo-foo-dev", nil, "foo-deploy-abcde")
+	if err == nil {
+		t.Fatal("want err when state exists for both suffixes, got none")
+	}
+}
+
+func TestMoveStateSecretsRollsBackOnCreateError(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		stateSecret("default", "foo-dev"),
+		stateSecret("feature", "foo-dev"),
+	)
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.CreateAction).GetObject().(*corev1.Secret)
+		if secret.Name == "tfstate-feature-proj-repo-foo-dev" {
+			return true, nil, errors.New("injected")
+		}
+		return false, nil, nil
+	})
+	moved, err := MoveStateSecrets(clientset, "ns", "foo-dev", "proj-repo-foo-dev", nil, "foo-deploy-abcde")
+	if err == nil {
+		t.Fatal("want err, got none")
+	}
+	if len(moved) != 0 {
+		t.Fatalf("want nothing moved, got %v", moved)
+	}
+	created, err := ListStateSecrets(clientset, "ns", "proj-repo-foo-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 0 {
+		t.Fatalf("want created state secrets removed again, got %d", len(created))
+	}
+	remaining, err := ListStateSecrets(clientset, "ns", "foo-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("want previous state secrets kept, got %d", len(remaining))
+	}
+}
+
+func TestMoveStateSecretsLocked(t *testing.T) {
+	holder := "3f2e6a7c-terraform"
+	clientset := fake.NewSimpleClientset(
+		stateSecret("default", "foo-dev"),
+		stateSecret("feature", "foo-dev"),
+		stateLease("tfstate-feature-foo-dev", &holder),
+	)
+	_, err := MoveStateSecrets(clientset, "ns", "foo-dev", "proj-repo-foo-dev", nil, "foo-deploy-abcde")
+	if err == nil || err.Error() != "lock state: state secret tfstate-feature-foo-dev is locked by "+holder {
+		t.Fatalf("want err for locked state, got %v", err)
+	}
+	remaining, err := ListStateSecrets(clientset, "ns", "foo-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("want previous state secrets kept, got %d", len(remaining))
+	}
+	leases, err := clientset.CoordinationV1().Leases("ns").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Items) != 1 || *leases.Items[0].Spec.HolderIdentity != holder {
+		t.Fatalf("want only the lease of terraform left, got %v", leases.Items)
+	}
+}
@@ -0,0 +1,141 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// Client reads secrets from a HashiCorp Vault compatible server,
+// authenticating with a Kubernetes service account token.
+type Client struct {
+	// Address of the server, e.g. https://vault.example.com:8200.
+	Addr string
+	// Path at which the Kubernetes auth method is mounted, e.g. kubernetes.
+	AuthPath string
+	// Role to login with.
+	Role string
+	// File containing the service account token (JWT).
+	TokenFile string
+
+	httpClient *http.Client
+	token      string
+}
+
+// NewClient returns a client for the server at addr.
+func NewClient(addr, authPath, role, tokenFile string) *Client {
+	return &Client{
+		Addr:       strings.TrimSuffix(addr, "/"),
+		AuthPath:   strings.Trim(authPath, "/"),
+		Role:       role,
+		TokenFile:  tokenFile,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+type loginResponse struct {
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+type kvResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+type errorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// Login exchanges the service account token for a client token.
+// It is called by ReadKV if the client is not logged in yet.
+func (c *Client) Login() error {
+	jwt, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("read service account token: %w", err)
+	}
+	body, err := json.Marshal(map[string]string{
+		"role": c.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return err
+	}
+	var r loginResponse
+	err = c.do(http.MethodPost, fmt.Sprintf("/v1/auth/%s/login", c.AuthPath), bytes.NewReader(body), &r)
+	if err != nil {
+		return fmt.Errorf("login with role %s: %w", c.Role, err)
+	}
+	if r.Auth.ClientToken == "" {
+		return fmt.Errorf("login with role %s: no client token in response", c.Role)
+	}
+	c.token = r.Auth.ClientToken
+	return nil
+}
+
+// ReadKV reads the secret at path from the KV version 2 secrets engine
+// mounted at mount. Values which are not strings are returned JSON encoded.
+func (c *Client) ReadKV(mount, path string) (map[string]string, error) {
+	if c.token == "" {
+		if err := c.Login(); err != nil {
+			return nil, err
+		}
+	}
+	var r kvResponse
+	err := c.do(http.MethodGet, fmt.Sprintf("/v1/%s/data/%s", strings.Trim(mount, "/"), strings.Trim(path, "/")), nil, &r)
+	if err != nil {
+		return nil, fmt.Errorf("read %s/%s: %w", mount, path, err)
+	}
+	data := make(map[string]string)
+	for k, v := range r.Data.Data {
+		if s, ok := v.(string); ok {
+			data[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("encode value of %s: %w", k, err)
+		}
+		data[k] = string(b)
+	}
+	return data, nil
+}
+
+func (c *Client) do(method, urlPath string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, c.Addr+urlPath, body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var e errorResponse
+		if json.Unmarshal(b, &e) == nil && len(e.Errors) > 0 {
+			return fmt.Errorf("status %d: %s", res.StatusCode, strings.Join(e.Errors, ", "))
+		}
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return json.Unmarshal(b, v)
+}
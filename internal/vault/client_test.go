@@ -0,0 +1,94 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// newTestServer returns a stand-in for a Vault server which accepts the
+// given jwt for role and serves the given KV v2 secrets.
+func newTestServer(t *testing.T, role, jwt string, secrets map[string]map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["role"] != role || body["jwt"] != jwt {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"auth": {"client_token": "client-token"}}`))
+	})
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "client-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		data, ok := secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": data},
+		})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeToken(t *testing.T, token string) string {
+	f := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(f, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReadKV(t *testing.T) {
+	srv := newTestServer(t, "terraform", "sa-jwt", map[string]map[string]interface{}{
+		"/v1/secret/data/foo/dev": {
+			"ARM_CLIENT_SECRET": "s3cr3t",
+			"TF_VAR_count":      3,
+		},
+	})
+
+	c := NewClient(srv.URL+"/", "kubernetes", "terraform", writeToken(t, "sa-jwt"))
+	got, err := c.ReadKV("secret", "foo/dev")
+	if err != nil {
+		t.Fatalf("want no err, got %s", err)
+	}
+	want := map[string]string{
+		"ARM_CLIENT_SECRET": "s3cr3t",
+		"TF_VAR_count":      "3",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = c.ReadKV("secret", "foo/prod")
+	if err == nil {
+		t.Fatal("want err for missing secret, got none")
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	srv := newTestServer(t, "terraform", "sa-jwt", nil)
+	c := NewClient(srv.URL, "kubernetes", "terraform", writeToken(t, "other-jwt"))
+	_, err := c.ReadKV("secret", "foo/dev")
+	if err == nil {
+		t.Fatal("want err, got none")
+	}
+	want := "login with role terraform: status 403: permission denied"
+	if err.Error() != want {
+		t.Fatalf("want: %s, got: %s", want, err)
+	}
+}